@@ -0,0 +1,102 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// answerFlags maps the keys of the answers file to the setup flags they answer.
+var answerFlags = map[string]string{
+	"device_type":             "device-type",
+	"hosted_mender":           "hosted-mender",
+	"username":                "username",
+	"password":                "password",
+	"tenant_token":            "tenant-token",
+	"demo_server":             "demo-server",
+	"server_url":              "server-url",
+	"server_ip":               "server-ip",
+	"server_api_path_prefix":  "server-api-path-prefix",
+	"server_cert":             "server-cert",
+	"client_cert":             "client-cert",
+	"client_key":              "client-key",
+	"ssl_engine":              "ssl-engine",
+	"demo_polling":            "demo-polling",
+	"update_poll_interval":    "update-poll",
+	"inventory_poll_interval": "inventory-poll",
+	"retry_poll_interval":     "retry-poll",
+	"http_proxy":              "http-proxy",
+	"https_proxy":             "https-proxy",
+	"no_proxy":                "no-proxy",
+	"disable_keep_alive":      "disable-keep-alive",
+	"idle_conn_timeout":       "idle-conn-timeout",
+	"prefer_ipv4":             "prefer-ipv4",
+	"check_clock":             "check-clock",
+	"max_clock_skew":          "max-clock-skew",
+	"identity_source":         "identity-source",
+	"identity_uuid":           "identity-uuid",
+
+	// Dual root file system updates
+	"rootfs_part_a":             "rootfs-part-a",
+	"rootfs_part_b":             "rootfs-part-b",
+	"boot_set_active_part":      "boot-set-active-part",
+	"boot_get_next_active_part": "boot-get-next-active-part",
+}
+
+// applyAnswersFile reads the answers file given by --answers-file, a JSON or
+// YAML document, and sets every flag it answers which is not already given.
+// Setup then proceeds as if the flags were given, so explicit flags take
+// precedence, and only the questions left unanswered are prompted for.
+func applyAnswersFile(ctx *cli.Context) error {
+	answersFile := ctx.String("answers-file")
+	if answersFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(answersFile)
+	if err != nil {
+		return errors.Wrap(err, "Error reading answers file")
+	}
+	// YAML is a superset of JSON, so this parses both.
+	answers := map[string]interface{}{}
+	if err = yaml.Unmarshal(data, &answers); err != nil {
+		return errors.Wrapf(err, "Error parsing answers file %q", answersFile)
+	}
+
+	keys := make([]string, 0, len(answers))
+	for key := range answers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		flag, ok := answerFlags[key]
+		if !ok {
+			return errors.Errorf("Unknown key %q in answers file %q",
+				key, answersFile)
+		}
+		if ctx.IsSet(flag) || answers[key] == nil {
+			continue
+		}
+		if err = ctx.Set(flag, fmt.Sprint(answers[key])); err != nil {
+			return errors.Wrapf(err, "Invalid value for %q in answers file %q",
+				key, answersFile)
+		}
+	}
+	return nil
+}
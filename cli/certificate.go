@@ -0,0 +1,151 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	pemBeginPrefix = "-----BEGIN"
+
+	rspInvalidCertificate = "The file '%s' does not contain a valid PEM " +
+		"certificate.\nPlease try again: "
+	rspInvalidPastedCertificate = "The pasted text is not a valid PEM " +
+		"certificate.\nPlease try again: "
+	rspInvalidClientCertificate = "%s\nPlease try again.\n"
+	rspSuggestServerCert        = "If the server uses a certificate signed by a " +
+		"private CA, give the CA certificate with --server-cert."
+)
+
+// validateCertificatePEM returns an error unless data holds at least one PEM
+// encoded certificate, and all the certificates in it can be parsed.
+func validateCertificatePEM(data []byte) error {
+	found := 0
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return errors.Wrap(err, "Invalid certificate")
+		}
+		found++
+	}
+	if found == 0 {
+		return errors.New("No PEM encoded certificate found")
+	}
+	return nil
+}
+
+func validateCertificateFile(certFile string) error {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to read certificate %q", certFile)
+	}
+	return errors.Wrapf(validateCertificatePEM(data),
+		"Invalid certificate file %q", certFile)
+}
+
+// validateClientCertificate checks that the client certificate and key can be
+// used for mutual TLS. With an SSL engine the key is an engine identifier
+// rather than a file, so only the certificate is checked.
+func validateClientCertificate(certFile, keyFile, sslEngine string) error {
+	if certFile == "" || keyFile == "" {
+		return errors.New("Both a client certificate and a key must be given")
+	}
+	if sslEngine != "" {
+		return validateCertificateFile(certFile)
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return errors.Wrapf(err, "Unable to load client certificate %q "+
+			"with key %q", certFile, keyFile)
+	}
+	return nil
+}
+
+// validateArtifactVerifyKey checks that keyFile holds a PEM encoded public key
+// of a type artifact signatures can be made with.
+func validateArtifactVerifyKey(keyFile string) error {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to read artifact verification key %q",
+			keyFile)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return errors.Errorf("The artifact verification key %q is not a "+
+			"PEM encoded public key", keyFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid artifact verification key %q",
+			keyFile)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return nil
+	}
+	return errors.Errorf("Unsupported type %T of artifact verification key %q",
+		key, keyFile)
+}
+
+// readPastedPEM reads PEM data pasted by the user, starting with firstLine,
+// until an empty line is entered.
+func (stdin *stdinReader) readPastedPEM(firstLine string) ([]byte, error) {
+	var buf bytes.Buffer
+	line := firstLine
+	for strings.TrimSpace(line) != "" {
+		buf.WriteString(strings.TrimSpace(line) + "\n")
+		var err error
+		if line, err = stdin.reader.ReadString('\n'); err != nil {
+			return nil, errors.Wrap(err, "Error reading from stdin.")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// writeCertificateFile writes the PEM data to certFile, creating the
+// directory if needed.
+func writeCertificateFile(certFile string, data []byte) error {
+	if err := os.MkdirAll(path.Dir(certFile), 0755); err != nil {
+		return errors.Wrapf(err, "Cannot create directory %q", path.Dir(certFile))
+	}
+	if err := ioutil.WriteFile(certFile, data, 0644); err != nil {
+		return errors.Wrapf(err, "Error writing certificate %q", certFile)
+	}
+	return nil
+}
+
+// isCertificateError makes a best effort guess whether err is caused by the
+// server certificate not being trusted.
+func isCertificateError(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "certificate")
+}
@@ -0,0 +1,324 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/conf"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/device"
+	"github.com/mendersoftware/mender/store"
+)
+
+const (
+	checkUpdateDescription = "Asks the server whether a deployment is " +
+		"pending for this device, authenticating with the device key the " +
+		"same way the client does. Prints the deployment if there is one. " +
+		"Nothing is downloaded or installed."
+
+	rspUpdateAvailableF = "Update available: artifact %q, deployment %s\n"
+	rspNoUpdate         = "No update available"
+
+	showCurrentDescription = "Prints the name and the provides of the " +
+		"installed artifact, and the device type, exactly as the client " +
+		"sends them to the server when it asks for an update. Nothing " +
+		"is sent to the server."
+
+	// Defaults of --max-response-size, in KiB, and --response-timeout.
+	defaultMaxResponseSize = 1024
+	defaultResponseTimeout = 30 * time.Second
+)
+
+var (
+	errResponseTooLarge = errors.New("the server response is too large")
+	errResponseTooSlow  = errors.New("the server response took too long to read")
+)
+
+// checkUpdateResult is the outcome of check-update, for --json.
+type checkUpdateResult struct {
+	UpdateAvailable bool   `json:"update_available"`
+	ArtifactName    string `json:"artifact_name,omitempty"`
+	DeploymentID    string `json:"deployment_id,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// currentProvides returns the provides of the installed artifact, including
+// its name, as stored by the client. The database is only opened if it exists,
+// so that nothing is created in the data directory.
+func currentProvides(dataStore string) map[string]string {
+	if _, err := os.Stat(path.Join(dataStore, store.DBStoreName)); err != nil {
+		log.Debugf("No client database in %q: %s", dataStore, err.Error())
+		return nil
+	}
+	dbStore := store.NewDBStore(dataStore)
+	if dbStore == nil {
+		return nil
+	}
+	defer dbStore.Close()
+	provides, err := datastore.LoadProvides(dbStore)
+	if err != nil {
+		log.Debugf("No provides in the client database: %s", err.Error())
+		return nil
+	}
+	return provides
+}
+
+// currentUpdate describes the installed artifact the same way the client does
+// when it asks the server for an update.
+func currentUpdate(config *conf.MenderConfig,
+	dataStore string) (*client.CurrentUpdate, error) {
+	deviceTypeFile := config.DeviceTypeFile
+	if deviceTypeFile == "" {
+		deviceTypeFile = path.Join(dataStore, "device_type")
+	}
+	deviceType, err := device.GetDeviceType(deviceTypeFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read the device type from %q",
+			deviceTypeFile)
+	}
+	provides := currentProvides(dataStore)
+	return &client.CurrentUpdate{
+		Artifact:   provides["artifact_name"],
+		DeviceType: deviceType,
+		Provides:   provides,
+	}, nil
+}
+
+// boundedBodyRequester limits the size of the response bodies of the requests
+// made through it, and the time spent reading them, so that a slow or
+// malicious server cannot hold the update check forever. A maxSize or timeout
+// of 0 leaves the size or the time unbounded.
+type boundedBodyRequester struct {
+	api     client.ApiRequester
+	maxSize int64
+	timeout time.Duration
+}
+
+func (b *boundedBodyRequester) Do(req *http.Request) (*http.Response, error) {
+	rsp, err := b.api.Do(req)
+	if err != nil {
+		return rsp, err
+	}
+	body := &boundedBody{body: rsp.Body, remaining: b.maxSize}
+	if b.maxSize <= 0 {
+		// One less, so that reading one byte more than remaining
+		// does not overflow.
+		body.remaining = math.MaxInt64 - 1
+	}
+	if b.timeout > 0 {
+		body.timer = time.AfterFunc(b.timeout, func() {
+			atomic.StoreInt32(&body.expired, 1)
+			rsp.Body.Close()
+		})
+	}
+	rsp.Body = body
+	return rsp, nil
+}
+
+// boundedBody fails with errResponseTooLarge once more than the remaining
+// bytes are read, and with errResponseTooSlow once the timer has closed it.
+type boundedBody struct {
+	body      io.ReadCloser
+	remaining int64
+	timer     *time.Timer
+	expired   int32
+}
+
+func (b *boundedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.body.Read(p)
+	b.remaining -= int64(n)
+	if atomic.LoadInt32(&b.expired) != 0 {
+		return n, errResponseTooSlow
+	}
+	if b.remaining < 0 {
+		b.Close()
+		return n, errResponseTooLarge
+	}
+	return n, err
+}
+
+func (b *boundedBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	return b.body.Close()
+}
+
+// checkUpdate asks the server for the next deployment of the device, which has
+// the current artifact installed. The response must be at most maxSize bytes,
+// read within timeout.
+func checkUpdate(config *conf.MenderConfig, dataStore string,
+	current *client.CurrentUpdate, maxSize int64,
+	timeout time.Duration) (*checkUpdateResult, error) {
+	api, serverURL, err := authorizeDevice(context.Background(), config,
+		dataStore)
+	if err != nil {
+		return nil, err
+	}
+	api = &boundedBodyRequester{api: api, maxSize: maxSize, timeout: timeout}
+	data, err := client.NewUpdate().GetScheduledUpdate(api, serverURL, current)
+	switch errors.Cause(err) {
+	case nil:
+	case client.ErrNoDeploymentAvailable:
+		return &checkUpdateResult{}, nil
+	case client.ErrNotAuthorized:
+		return nil, errNotAccepted
+	default:
+		return nil, errors.Wrap(err, "update check FAILED")
+	}
+	update, ok := data.(client.UpdateResponse)
+	if !ok || update.UpdateInfo == nil {
+		return nil, errors.New("unexpected response to the update check")
+	}
+	return &checkUpdateResult{
+		UpdateAvailable: true,
+		ArtifactName:    update.ArtifactName(),
+		DeploymentID:    update.ID,
+	}, nil
+}
+
+func (runOptions *runOptionsType) checkUpdateCLIHandler(ctx *cli.Context) error {
+	if ctx.Args().Len() > 0 {
+		return errors.Errorf(
+			errMsgAmbiguousArgumentsGivenF,
+			ctx.Args().First())
+	}
+	if !ctx.IsSet("log-level") {
+		log.SetLevel(log.ErrorLevel)
+	}
+	configFormat := ctx.String("config-format")
+	if err := validateConfigFormat(configFormat); err != nil {
+		return err
+	}
+	runOptions.dataStore = ctx.String("data")
+
+	config, err := loadConfig(runOptions.config, runOptions.fallbackConfig,
+		configFormat)
+	if err != nil {
+		return err
+	}
+	logRedactor.addSecret(config.TenantToken)
+	var result *checkUpdateResult
+	current, err := currentUpdate(config, runOptions.dataStore)
+	if err == nil {
+		if ctx.IsSet("artifact-name") {
+			current.Artifact = ctx.String("artifact-name")
+		}
+		result, err = checkUpdate(config, runOptions.dataStore, current,
+			int64(ctx.Uint64("max-response-size"))*1024,
+			ctx.Duration("response-timeout"))
+	}
+	if ctx.Bool("json") {
+		if result == nil {
+			result = &checkUpdateResult{Error: err.Error()}
+		}
+		data, pErr := json.MarshalIndent(result, "", "    ")
+		if pErr != nil {
+			return errors.Wrap(pErr, "Unable to marshal the update check result")
+		}
+		fmt.Fprintln(ctx.App.Writer, string(data))
+		if err != nil {
+			return cli.Exit("", 1)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if result.UpdateAvailable {
+		fmt.Fprintf(ctx.App.Writer, rspUpdateAvailableF,
+			result.ArtifactName, result.DeploymentID)
+	} else {
+		fmt.Fprintln(ctx.App.Writer, rspNoUpdate)
+	}
+	return nil
+}
+
+func (runOptions *runOptionsType) showCurrentCLIHandler(ctx *cli.Context) error {
+	if ctx.Args().Len() > 0 {
+		return errors.Errorf(
+			errMsgAmbiguousArgumentsGivenF,
+			ctx.Args().First())
+	}
+	if !ctx.IsSet("log-level") {
+		log.SetLevel(log.ErrorLevel)
+	}
+	configFormat := ctx.String("config-format")
+	if err := validateConfigFormat(configFormat); err != nil {
+		return err
+	}
+	runOptions.dataStore = ctx.String("data")
+
+	config, err := loadConfig(runOptions.config, runOptions.fallbackConfig,
+		configFormat)
+	if err != nil {
+		return err
+	}
+	current, err := currentUpdate(config, runOptions.dataStore)
+	if err != nil {
+		return err
+	}
+	// The very encoding the client sends, which merges the artifact name
+	// and the device type into the provides.
+	data, err := current.MarshalJSON()
+	if err != nil {
+		return errors.Wrap(err, "Unable to marshal the installed artifact")
+	}
+	if ctx.Bool("json") {
+		var indented bytes.Buffer
+		if err = json.Indent(&indented, data, "", "    "); err != nil {
+			return errors.Wrap(err, "Unable to marshal the installed artifact")
+		}
+		fmt.Fprintln(ctx.App.Writer, indented.String())
+		return nil
+	}
+	// Decoded from the same encoding, so that both outputs always match.
+	var provides map[string]string
+	if err = json.Unmarshal(data, &provides); err != nil {
+		return errors.Wrap(err, "Unable to decode the installed artifact")
+	}
+	keys := make([]string, 0, len(provides))
+	for key := range provides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(ctx.App.Writer, "%s=%s\n", key, provides[key])
+	}
+	return nil
+}
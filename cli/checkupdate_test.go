@@ -0,0 +1,137 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func TestBoundedBodyRequester(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/trickle" {
+				w.Write([]byte(strings.Repeat("x", 2048)))
+				return
+			}
+			// Trickle a byte at a time, until the client gives up.
+			for {
+				if _, err := w.Write([]byte("x")); err != nil {
+					return
+				}
+				w.(http.Flusher).Flush()
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		}))
+	defer server.Close()
+
+	get := func(path string, maxSize int64,
+		timeout time.Duration) ([]byte, error) {
+		api := &boundedBodyRequester{api: server.Client(), maxSize: maxSize,
+			timeout: timeout}
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		assert.NoError(t, err)
+		rsp, err := api.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, err
+		}
+		defer rsp.Body.Close()
+		return ioutil.ReadAll(rsp.Body)
+	}
+
+	data, err := get("/", 2048, 200*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Len(t, data, 2048)
+
+	_, err = get("/", 1024, 200*time.Millisecond)
+	assert.Equal(t, errResponseTooLarge, err)
+
+	start := time.Now()
+	_, err = get("/trickle", 1<<20, 200*time.Millisecond)
+	assert.Equal(t, errResponseTooSlow, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// Zero leaves the size, or the time, unbounded.
+	data, err = get("/", 0, 200*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Len(t, data, 2048)
+
+	data, err = get("/", 2048, 0)
+	assert.NoError(t, err)
+	assert.Len(t, data, 2048)
+
+	_, err = get("/trickle", 8, 0)
+	assert.Equal(t, errResponseTooLarge, err)
+}
+
+// runShowCurrent runs the show-current command with args, and returns what it
+// printed.
+func runShowCurrent(t *testing.T, args ...string) string {
+	var out bytes.Buffer
+	runOptions := &runOptionsType{}
+	app := &cli.App{
+		Writer: &out,
+		Commands: []*cli.Command{{
+			Name:   "show-current",
+			Action: runOptions.showCurrentCLIHandler,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "config",
+					Destination: &runOptions.config},
+				&cli.StringFlag{Name: "config-format",
+					Value: configFormatJSON},
+				&cli.StringFlag{Name: "data"},
+				&cli.BoolFlag{Name: "json"},
+			},
+		}},
+	}
+	assert.NoError(t, app.Run(append([]string{"mender-setup",
+		"show-current"}, args...)))
+	return out.String()
+}
+
+func TestShowCurrent(t *testing.T) {
+	// No client database, as on a device which has not run the client yet.
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "mender.conf")
+	assert.NoError(t, ioutil.WriteFile(configFile,
+		[]byte(`{"ServerURL": "https://mender.example.com"}`), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "device_type"),
+		[]byte("device_type=raspberrypi4"), 0644))
+
+	args := []string{"--config", configFile, "--data", dir}
+	assert.Equal(t, "artifact_name=\ndevice_type=raspberrypi4\n",
+		runShowCurrent(t, args...))
+
+	var provides map[string]string
+	assert.NoError(t, json.Unmarshal(
+		[]byte(runShowCurrent(t, append(args, "--json")...)), &provides))
+	assert.Equal(t, map[string]string{
+		"artifact_name": "",
+		"device_type":   "raspberrypi4",
+	}, provides)
+}
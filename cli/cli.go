@@ -31,10 +31,17 @@ import (
 
 	"github.com/mendersoftware/mender/client"
 	"github.com/mendersoftware/mender/conf"
+	"github.com/mendersoftware/mender/device"
 )
 
 var (
 	errDumpTerminal = errors.New("Refusing to write to terminal")
+
+	// secretSetupFlags are the setup flags whose values must not be shown.
+	secretSetupFlags = map[string]bool{
+		"password":     true,
+		"tenant-token": true,
+	}
 )
 
 const (
@@ -51,13 +58,31 @@ const (
 		"is physically accessible."
 	snapshotDumpDescription = "Dump rootfs to standard out. Exits if " +
 		"output isn't redirected."
+	setupDescription = "Generates the configuration file, prompting for " +
+		"the options which are not given as flags. Every option can also " +
+		"be given as an environment variable named after the flag, e.g. " +
+		"MENDER_SETUP_SERVER_URL for --server-url. Flags take precedence " +
+		"over environment variables, which take precedence over the " +
+		"answers file.\n" +
+		"\tExit codes: 0 when the configuration is written or up to date, " +
+		"1 on any other error, 3 when the configuration is up to date " +
+		"with --detailed-exit-codes, 4 for invalid or missing options, " +
+		"5 when the server is not reachable."
+	dumpConfigDescription = "Loads the existing configuration file, applies " +
+		"the options given as flags the same way setup would, and prints " +
+		"the result to standard out. Options that are not given are left " +
+		"as they are in the configuration file."
 )
 
 const (
+	// Prefix of the environment variables setting the setup flags.
+	setupEnvPrefix = "MENDER_SETUP_"
+
 	errMsgAmbiguousArgumentsGivenF = "Ambiguous arguments given - " +
 		"unrecognized argument: %s"
 	errMsgConflictingArgumentsF = "Conflicting arguments given, only one " +
 		"of the following flags may be given: {%q, %q}"
+	errMsgConfigDirF = "Unable to write the configuration file %q: %s"
 )
 
 type runOptionsType struct {
@@ -79,6 +104,7 @@ func ShowVersion() string {
 
 func SetupCLI(args []string) error {
 	runOptions := &runOptionsType{}
+	installLogRedactor()
 
 	app := &cli.App{
 		Description: appDescription,
@@ -91,16 +117,119 @@ func SetupCLI(args []string) error {
 			Name: "setup",
 			Usage: "Perform configuration setup - " +
 				"'mender setup --help' for command options.",
-			ArgsUsage: "[options]",
-			Action:    runOptions.setupCLIHandler,
+			Description: setupDescription,
+			ArgsUsage:   "[options]",
+			Action:      runOptions.setupCLIHandler,
+			Flags:       runOptions.setupFlags(),
+		},
+		{
+			Name:        "reset",
+			Usage:       "Remove the authentication state, then run setup.",
+			Description: resetDescription,
+			ArgsUsage:   "[options]",
+			Action:      runOptions.setupCLIHandler,
+			Flags: append(runOptions.setupFlags(),
+				&cli.BoolFlag{
+					Name:  "keep-identity",
+					Usage: "Keep the device key, so the device keeps its identity.",
+				},
+				&cli.BoolFlag{
+					Name:  "clear-update-state",
+					Usage: "Also remove the state of an interrupted update.",
+				},
+				&cli.BoolFlag{
+					Name:  "yes",
+					Usage: "Do not ask for confirmation.",
+				},
+			),
+		},
+		{
+			Name: "dump-config",
+			Usage: "Print the configuration setup would generate, " +
+				"without writing anything.",
+			Description: dumpConfigDescription,
+			ArgsUsage:   "[options]",
+			Action:      runOptions.dumpConfigCLIHandler,
+			Flags: append(runOptions.setupFlags(),
+				&cli.StringFlag{
+					Name:  "output-format",
+					Usage: "`FORMAT` of the printed configuration {json,yaml,toml}.",
+					Value: configFormatJSON,
+				},
+				&cli.BoolFlag{
+					Name:  "show-secrets",
+					Usage: "Print the tenant token unmasked.",
+				},
+			),
+		},
+		{
+			Name:        "print-defaults",
+			Usage:       "Print a commented configuration file with the default values.",
+			Description: printDefaultsDescription,
+			ArgsUsage:   "[options]",
+			Action:      printDefaultsCLIHandler,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "output-format",
+					Usage: "`FORMAT` of the printed configuration {json,yaml,toml}.",
+					Value: configFormatJSON,
+				},
+			},
+		},
+		{
+			Name:        "list-device-types",
+			Usage:       "Print candidate device types for this device.",
+			Description: listDeviceTypesDescription,
+			ArgsUsage:   "[options]",
+			Action:      listDeviceTypesCLIHandler,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "data",
+					Aliases: []string{"d"},
+					Usage:   "Mender state data `DIR`ECTORY path.",
+					Value:   conf.DefaultDataStore,
+				},
+				&cli.StringFlag{
+					Name:  "device-type-file",
+					Usage: "`PATH` to an existing device type file.",
+					Value: path.Join(conf.GetConfDirPath(), "device_type"),
+				},
+				&cli.StringFlag{
+					Name:  "server-url",
+					Usage: "`URL` of the server to list the device types of.",
+				},
+				&cli.StringFlag{
+					Name: "admin-token",
+					Usage: "User `TOKEN` allowed to read the device " +
+						"inventory of the server.",
+					EnvVars: []string{"MENDER_ADMIN_TOKEN"},
+				},
+				&cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "Maximum `duration` of the inventory request.",
+					Value: defaultNetworkTimeout,
+				},
+			},
+		},
+		{
+			Name:        "check-update",
+			Usage:       "Ask the server whether an update is available.",
+			Description: checkUpdateDescription,
+			ArgsUsage:   "[options]",
+			Action:      runOptions.checkUpdateCLIHandler,
 			Flags: []cli.Flag{
 				&cli.StringFlag{
 					Name:        "config",
 					Aliases:     []string{"c"},
-					Destination: &runOptions.setupOptions.configPath,
+					Destination: &runOptions.config,
 					Value:       conf.DefaultConfFile,
 					Usage:       "`PATH` to configuration file.",
 				},
+				&cli.StringFlag{
+					Name:  "config-format",
+					Value: configFormatJSON,
+					Usage: "`FORMAT` of the configuration file {json,yaml,toml}.",
+				},
 				&cli.StringFlag{
 					Name:    "data",
 					Aliases: []string{"d"},
@@ -108,85 +237,126 @@ func SetupCLI(args []string) error {
 					Value:   conf.DefaultDataStore,
 				},
 				&cli.StringFlag{
-					Name:        "device-type",
-					Destination: &runOptions.setupOptions.deviceType,
-					Usage:       "Name of the device `type`.",
+					Name: "artifact-name",
+					Usage: "`NAME` of the installed artifact; read from the " +
+						"client database if not given.",
 				},
-				&cli.StringFlag{
-					Name:        "username",
-					Destination: &runOptions.setupOptions.username,
-					Usage:       "User `E-Mail` at hosted.mender.io.",
+				&cli.Uint64Flag{
+					Name:  "max-response-size",
+					Value: defaultMaxResponseSize,
+					Usage: "Maximum `SIZE` of the server response, in KiB; " +
+						"0 for no limit.",
 				},
+				&cli.DurationFlag{
+					Name:  "response-timeout",
+					Value: defaultResponseTimeout,
+					Usage: "Maximum `TIME` to read the server response; " +
+						"0 for no limit.",
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the result as JSON.",
+				},
+			},
+		},
+		{
+			Name:        "show-current",
+			Usage:       "Print the installed artifact as the server sees it.",
+			Description: showCurrentDescription,
+			ArgsUsage:   "[options]",
+			Action:      runOptions.showCurrentCLIHandler,
+			Flags: []cli.Flag{
 				&cli.StringFlag{
-					Name:        "password",
-					Destination: &runOptions.setupOptions.password,
-					Usage:       "User `PASSWORD` at hosted.mender.io.",
+					Name:        "config",
+					Aliases:     []string{"c"},
+					Destination: &runOptions.config,
+					Value:       conf.DefaultConfFile,
+					Usage:       "`PATH` to configuration file.",
 				},
 				&cli.StringFlag{
-					Name:        "server-url",
-					Aliases:     []string{"url"},
-					Destination: &runOptions.setupOptions.serverURL,
-					Usage:       "`URL` to Mender server.",
-					Value:       "https://docker.mender.io",
+					Name:  "config-format",
+					Value: configFormatJSON,
+					Usage: "`FORMAT` of the configuration file {json,yaml,toml}.",
 				},
 				&cli.StringFlag{
-					Name:        "server-ip",
-					Destination: &runOptions.setupOptions.serverIP,
-					Usage:       "Server ip address.",
+					Name:    "data",
+					Aliases: []string{"d"},
+					Usage:   "Mender state data `DIR`ECTORY path.",
+					Value:   conf.DefaultDataStore,
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the result as JSON.",
 				},
+			},
+		},
+		{
+			Name:        "validate",
+			Usage:       "Check an existing configuration file without writing it.",
+			Description: validateDescription,
+			ArgsUsage:   "[options]",
+			Action:      runOptions.validateCLIHandler,
+			Flags: []cli.Flag{
 				&cli.StringFlag{
-					Name:        "server-cert",
-					Aliases:     []string{"E"},
-					Destination: &runOptions.setupOptions.serverCert,
-					Usage:       "`PATH` to trusted server certificates",
+					Name:        "config",
+					Aliases:     []string{"c", "config-path"},
+					Destination: &runOptions.config,
+					Value:       conf.DefaultConfFile,
+					Usage:       "`PATH` to configuration file.",
 				},
 				&cli.StringFlag{
-					Name:        "tenant-token",
-					Destination: &runOptions.setupOptions.tenantToken,
-					Usage:       "Hosted Mender tenant `token`",
-				},
-				&cli.IntFlag{
-					Name:        "inventory-poll",
-					Destination: &runOptions.setupOptions.invPollInterval,
-					Usage:       "Inventory poll interval in `sec`onds.",
-					Value:       defaultInventoryPoll,
-				},
-				&cli.IntFlag{
-					Name:        "retry-poll",
-					Destination: &runOptions.setupOptions.retryPollInterval,
-					Usage:       "Retry poll interval in `sec`onds.",
-					Value:       defaultRetryPoll,
-				},
-				&cli.IntFlag{
-					Name:        "update-poll",
-					Destination: &runOptions.setupOptions.updatePollInterval,
-					Usage:       "Update poll interval in `sec`onds.",
-					Value:       defaultUpdatePoll,
+					Name:  "config-format",
+					Value: configFormatJSON,
+					Usage: "`FORMAT` of the configuration file {json,yaml,toml}.",
 				},
 				&cli.BoolFlag{
-					Name:        "hosted-mender",
-					Destination: &runOptions.setupOptions.hostedMender,
-					Usage:       "Setup device towards Hosted Mender.",
+					Name:  "json",
+					Usage: "Print the problems found as JSON.",
 				},
-				&cli.BoolFlag{
-					Name:        "demo",
-					Destination: &runOptions.setupOptions.demo,
-					Usage: "Use demo configuration. DEPRECATED: use --demo-server and/or" +
-						" --demo-polling instead",
+			},
+		},
+		{
+			Name:        "verify",
+			Usage:       "Check that the existing installation is able to update.",
+			Description: verifyDescription,
+			ArgsUsage:   "[options]",
+			Action:      runOptions.verifyCLIHandler,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "config",
+					Aliases:     []string{"c"},
+					Destination: &runOptions.config,
+					Value:       conf.DefaultConfFile,
+					Usage:       "`PATH` to configuration file.",
 				},
-				&cli.BoolFlag{
-					Name:        "demo-server",
-					Destination: &runOptions.setupOptions.demoServer,
-					Usage:       "Use demo server configuration.",
+				&cli.StringFlag{
+					Name:  "config-format",
+					Value: configFormatJSON,
+					Usage: "`FORMAT` of the configuration file {json,yaml,toml}.",
 				},
-				&cli.BoolFlag{
-					Name:        "demo-polling",
-					Destination: &runOptions.setupOptions.demoIntervals,
-					Usage:       "Use demo polling intervals.",
+				&cli.StringFlag{
+					Name:    "data",
+					Aliases: []string{"d"},
+					Usage:   "Mender state data `DIR`ECTORY path.",
+					Value:   conf.DefaultDataStore,
 				},
-				&cli.BoolFlag{
-					Name:  "quiet",
-					Usage: "Suppress informative prompts.",
+				&cli.StringFlag{
+					Name:  "device-type",
+					Usage: "Expected device `type`; any valid type if not given.",
+				},
+				&cli.Uint64Flag{
+					Name: "min-free-space",
+					Usage: "Free space in `MiB` needed in the data " +
+						"directory, which stands in for the update " +
+						"partition.",
+					Value: defaultMinFreeSpace,
+				},
+				&cli.DurationFlag{
+					Name: "timeout",
+					Usage: "Maximum `duration` of the connectivity check " +
+						"of every server, and of the authorization check; " +
+						"0 for no limit.",
+					Value: defaultNetworkTimeout,
 				},
 			},
 		},
@@ -237,17 +407,447 @@ func SetupCLI(args []string) error {
 	return app.Run(args)
 }
 
+// setupFlags returns the flags for configuring the setup, shared by all the
+// commands which generate a configuration.
+func (runOptions *runOptionsType) setupFlags() []cli.Flag {
+	flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:        "config",
+			Aliases:     []string{"c", "config-path"},
+			Destination: &runOptions.setupOptions.configPath,
+			Value:       conf.DefaultConfFile,
+			Usage: "`PATH` to configuration file. Missing parent " +
+				"directories are created.",
+		},
+		&cli.StringFlag{
+			Name:        "config-mode",
+			Destination: &runOptions.setupOptions.configMode,
+			Value:       defaultConfigMode,
+			Usage:       "Octal permission `MODE` of the configuration file.",
+		},
+		&cli.StringFlag{
+			Name:        "secrets-path",
+			Destination: &runOptions.setupOptions.secretsPath,
+			Usage: "Write the tenant token and the client key to a " +
+				"separate `PATH`, readable only by its owner, which the " +
+				"client reads as its fallback configuration.",
+		},
+		&cli.StringFlag{
+			Name:        "config-format",
+			Destination: &runOptions.setupOptions.configFormat,
+			Value:       configFormatJSON,
+			Usage: "`FORMAT` of the configuration file {json,yaml,toml}. " +
+				"The client only reads json, so the other formats are " +
+				"refused for " + conf.DefaultConfFile + ".",
+		},
+		&cli.StringFlag{
+			Name: "answers-file",
+			Usage: "`PATH` to a JSON or YAML file answering the setup " +
+				"questions; flags take precedence over the file.",
+		},
+		&cli.StringFlag{
+			Name:    "data",
+			Aliases: []string{"d"},
+			Usage:   "Mender state data `DIR`ECTORY path.",
+			Value:   conf.DefaultDataStore,
+		},
+		&cli.StringFlag{
+			Name:        "device-type",
+			Destination: &runOptions.setupOptions.deviceType,
+			Usage:       "Name of the device `type`.",
+		},
+		&cli.StringFlag{
+			Name: "device-type-file",
+			Usage: "`PATH` to an existing device type file, used as " +
+				"default device type.",
+			Value: path.Join(conf.GetConfDirPath(), "device_type"),
+		},
+		&cli.StringFlag{
+			Name:        "username",
+			Destination: &runOptions.setupOptions.username,
+			Usage:       "User `E-Mail` at hosted.mender.io.",
+		},
+		&cli.StringFlag{
+			Name:        "password",
+			Destination: &runOptions.setupOptions.password,
+			Usage:       "User `PASSWORD` at hosted.mender.io.",
+		},
+		&cli.StringFlag{
+			Name:        "server-url",
+			Aliases:     []string{"url"},
+			Destination: &runOptions.setupOptions.serverURL,
+			Usage: "`URL` to Mender server, or a comma separated " +
+				"list of URLs to fall over to.",
+			Value: "https://docker.mender.io",
+		},
+		&cli.StringFlag{
+			Name:        "server-api-path-prefix",
+			Destination: &runOptions.setupOptions.apiPathPrefix,
+			Usage: "`PATH` the server is hosted under, e.g. /mender " +
+				"for a server at https://example.com/mender/. Not " +
+				"added to a server URL already ending with it.",
+		},
+		&cli.StringFlag{
+			Name:        "server-ip",
+			Destination: &runOptions.setupOptions.serverIP,
+			Usage:       "Server ip address.",
+		},
+		&cli.StringFlag{
+			Name:        "server-cert",
+			Aliases:     []string{"E"},
+			Destination: &runOptions.setupOptions.serverCert,
+			Usage:       "`PATH` to trusted server certificates",
+		},
+		&cli.StringFlag{
+			Name:        "client-cert",
+			Destination: &runOptions.setupOptions.clientCert,
+			Usage:       "`PATH` to the client certificate for mutual TLS",
+		},
+		&cli.StringFlag{
+			Name:        "client-key",
+			Destination: &runOptions.setupOptions.clientKey,
+			Usage:       "`PATH` to the private key of the client certificate",
+		},
+		&cli.StringFlag{
+			Name:        "ssl-engine",
+			Destination: &runOptions.setupOptions.sslEngine,
+			Usage: "OpenSSL `engine` holding the client key, " +
+				"the key is then an engine key identifier",
+		},
+		&cli.BoolFlag{
+			Name:        "disable-keep-alive",
+			Destination: &runOptions.setupOptions.disableKeepAlive,
+			Usage: "Open a new connection to the server for every " +
+				"request, for load balancers dropping idle connections.",
+		},
+		&cli.IntFlag{
+			Name:        "idle-conn-timeout",
+			Destination: &runOptions.setupOptions.idleConnTimeout,
+			Usage: "Close connections to the server after being idle " +
+				"for `sec`onds; 0 keeps them open.",
+		},
+		&cli.BoolFlag{
+			Name:        "prefer-ipv4",
+			Destination: &runOptions.setupOptions.preferIPv4,
+			Usage: "Connect to the server over IPv4 if possible during " +
+				"setup, for hosts with broken IPv6. The connectivity " +
+				"check of an HTTPS server is not covered, as it " +
+				"connects like the client does.",
+		},
+		&cli.BoolFlag{
+			Name:        "check-clock",
+			Destination: &runOptions.setupOptions.checkClock,
+			Usage: "Warn during the connectivity check if the device " +
+				"clock differs from the server clock.",
+		},
+		&cli.DurationFlag{
+			Name:        "max-clock-skew",
+			Destination: &runOptions.setupOptions.maxClockSkew,
+			Value:       defaultMaxClockSkew,
+			Usage:       "Largest clock difference `TIME` --check-clock accepts.",
+		},
+		&cli.StringFlag{
+			Name:        "rootfs-part-a",
+			Destination: &runOptions.setupOptions.rootfsPartA,
+			Usage: "`DEVICE` of the first root file system partition, " +
+				"for dual rootfs updates.",
+		},
+		&cli.StringFlag{
+			Name:        "rootfs-part-b",
+			Destination: &runOptions.setupOptions.rootfsPartB,
+			Usage: "`DEVICE` of the second root file system partition, " +
+				"for dual rootfs updates.",
+		},
+		&cli.StringFlag{
+			Name:        "boot-set-active-part",
+			Destination: &runOptions.setupOptions.bootSetActive,
+			Usage: "`COMMAND` setting the partition to boot from; " +
+				"the client looks for the usual tools if not given.",
+		},
+		&cli.StringFlag{
+			Name:        "boot-get-next-active-part",
+			Destination: &runOptions.setupOptions.bootGetNextActive,
+			Usage: "`COMMAND` getting the partition to boot from; " +
+				"the client looks for the usual tools if not given.",
+		},
+		&cli.StringSliceFlag{
+			Name: "artifact-verify-key",
+			Usage: "`PATH` to a public key verifying signed artifacts; " +
+				"repeat for several keys, tried in order.",
+		},
+		&cli.BoolFlag{
+			Name:        "require-signed-artifacts",
+			Destination: &runOptions.setupOptions.requireSigned,
+			Usage: "Warn if no artifact verification key is configured, " +
+				"as the client then accepts unsigned artifacts.",
+		},
+		&cli.StringFlag{
+			Name:        "tenant-token",
+			Destination: &runOptions.setupOptions.tenantToken,
+			Usage:       "Hosted Mender tenant `token`",
+		},
+		&cli.StringFlag{
+			Name: "tenant-token-file",
+			Usage: "Read the tenant token from `FILE`, or from stdin " +
+				"if \"-\".",
+		},
+		&cli.IntFlag{
+			Name:        "inventory-poll",
+			Destination: &runOptions.setupOptions.invPollInterval,
+			Usage:       "Inventory poll interval in `sec`onds.",
+			Value:       defaultInventoryPoll,
+		},
+		&cli.IntFlag{
+			Name:        "retry-poll",
+			Destination: &runOptions.setupOptions.retryPollInterval,
+			Usage:       "Retry poll interval in `sec`onds.",
+			Value:       defaultRetryPoll,
+		},
+		&cli.IntFlag{
+			Name:        "update-poll",
+			Destination: &runOptions.setupOptions.updatePollInterval,
+			Usage:       "Update poll interval in `sec`onds.",
+			Value:       defaultUpdatePoll,
+		},
+		&cli.IntFlag{
+			Name:        "min-poll-interval",
+			Destination: &runOptions.setupOptions.minPollInterval,
+			Usage:       "Shortest poll interval in `sec`onds accepted.",
+			Value:       minimumPollInterval,
+		},
+		&cli.StringFlag{
+			Name:        "http-proxy",
+			Destination: &runOptions.setupOptions.httpProxy,
+			Usage:       "`URL` of the proxy to use for HTTP connections.",
+		},
+		&cli.StringFlag{
+			Name:        "https-proxy",
+			Destination: &runOptions.setupOptions.httpsProxy,
+			Usage:       "`URL` of the proxy to use for HTTPS connections.",
+		},
+		&cli.StringFlag{
+			Name:        "no-proxy",
+			Destination: &runOptions.setupOptions.noProxy,
+			Usage:       "Comma separated `LIST` of hosts to connect to without proxy.",
+		},
+		&cli.BoolFlag{
+			Name:        "hosted-mender",
+			Destination: &runOptions.setupOptions.hostedMender,
+			Usage:       "Setup device towards Hosted Mender.",
+		},
+		&cli.BoolFlag{
+			Name:        "demo",
+			Destination: &runOptions.setupOptions.demo,
+			Usage: "Configure a local demo without prompting: the demo " +
+				"server, short poll intervals and no server certificate " +
+				"verification. Not for production.",
+		},
+		&cli.BoolFlag{
+			Name:        "demo-server",
+			Destination: &runOptions.setupOptions.demoServer,
+			Usage:       "Use demo server configuration.",
+		},
+		&cli.BoolFlag{
+			Name:        "demo-polling",
+			Destination: &runOptions.setupOptions.demoIntervals,
+			Usage:       "Use demo polling intervals.",
+		},
+		&cli.BoolFlag{
+			Name:  "quiet",
+			Usage: "Suppress informative prompts.",
+		},
+		&cli.DurationFlag{
+			Name:        "timeout",
+			Destination: &runOptions.setupOptions.timeout,
+			Usage: "Maximum `duration` of every network operation " +
+				"of setup, e.g. 30s; 0 for no limit.",
+			Value: defaultNetworkTimeout,
+		},
+		&cli.DurationFlag{
+			Name:        "connect-timeout",
+			Destination: &runOptions.setupOptions.connectTimeout,
+			Usage: "Maximum `duration` of connecting to the server, " +
+				"including the TLS handshake; 0 leaves it to --timeout.",
+		},
+		&cli.DurationFlag{
+			Name:        "wait-reachable",
+			Destination: &runOptions.setupOptions.waitReachable,
+			Usage: "Keep retrying the connectivity check for up to " +
+				"`duration`, e.g. 5m, for networks which are not up yet.",
+		},
+		&cli.BoolFlag{
+			Name:        "wait-reachable-optional",
+			Destination: &runOptions.setupOptions.waitOptional,
+			Usage: "Save the configuration with a warning if the server " +
+				"is still not reachable after --wait-reachable.",
+		},
+		&cli.BoolFlag{
+			Name:        "trace-http",
+			Destination: &runOptions.setupOptions.traceHTTP,
+			Usage: "Log the connection events and headers of every " +
+				"request setup makes, at debug level.",
+		},
+		&cli.StringFlag{
+			Name:        "user-agent",
+			Destination: &runOptions.setupOptions.userAgent,
+			Usage: "User-Agent `HEADER` of the requests setup sends; " +
+				"mender-setup/<version> if not given.",
+		},
+		&cli.BoolFlag{
+			Name:        "skip-connectivity-check",
+			Destination: &runOptions.setupOptions.skipConnectivity,
+			Usage:       "Do not verify that the server is reachable.",
+		},
+		&cli.BoolFlag{
+			Name:        "verify-auth",
+			Destination: &runOptions.setupOptions.verifyAuth,
+			Usage: "After saving the configuration, authenticate with " +
+				"the server and report whether the device is " +
+				"authorized. Needs the device identity and key.",
+		},
+		&cli.BoolFlag{
+			Name:        "offline",
+			Destination: &runOptions.setupOptions.offline,
+			Usage: "Generate the configuration from the given options " +
+				"only, without any network access or checks of the " +
+				"files it refers to, except the artifact verification " +
+				"keys. Implies --skip-connectivity-check. " +
+				"The resulting configuration is unverified.",
+		},
+		&cli.BoolFlag{
+			Name:        "generate-systemd-unit",
+			Destination: &runOptions.setupOptions.systemdUnit,
+			Usage: "Generate a systemd service unit for running the " +
+				"client with this configuration.",
+		},
+		&cli.StringFlag{
+			Name:        "systemd-dir",
+			Destination: &runOptions.setupOptions.systemdDir,
+			Usage: "`DIR`ECTORY to write the systemd service unit to; " +
+				"printed to stdout if not given.",
+		},
+		&cli.StringFlag{
+			Name:        "mender-binary",
+			Destination: &runOptions.setupOptions.menderBinary,
+			Usage:       "`PATH` to the client binary in the systemd service unit.",
+			Value:       defaultMenderBinary,
+		},
+		&cli.StringFlag{
+			Name:        "identity-source",
+			Destination: &runOptions.setupOptions.identitySource,
+			Usage: "Set up the device identity script from `SOURCE`: " +
+				"\"mac\" for the MAC address, \"uuid\" for a UUID, or " +
+				"the path to an existing identity script.",
+		},
+		&cli.StringFlag{
+			Name:        "identity-uuid",
+			Destination: &runOptions.setupOptions.identityUUID,
+			Usage: "`UUID` identifying the device with --identity-source " +
+				"uuid; generated if not given.",
+		},
+		&cli.BoolFlag{
+			Name:        "no-backup",
+			Destination: &runOptions.setupOptions.noBackup,
+			Usage:       "Do not back up the existing configuration file.",
+		},
+		&cli.IntFlag{
+			Name:        "max-backups",
+			Destination: &runOptions.setupOptions.maxBackups,
+			Usage: "Maximum `NUMBER` of configuration file backups " +
+				"to keep, 0 keeps all.",
+			Value: defaultMaxBackups,
+		},
+		&cli.BoolFlag{
+			Name:        "dry-run",
+			Destination: &runOptions.setupOptions.dryRun,
+			Usage: "Print the changes to the configuration file " +
+				"instead of writing it.",
+		},
+		&cli.BoolFlag{
+			Name:        "merge",
+			Destination: &runOptions.setupOptions.merge,
+			Usage: "Only write the settings given as flags to the " +
+				"existing configuration file, keeping everything else.",
+		},
+		&cli.StringSliceFlag{
+			Name: "inventory",
+			Usage: "Static inventory attribute `KEY=VALUE` for the client " +
+				"to report; repeat for several attributes.",
+		},
+		&cli.StringSliceFlag{
+			Name: "post-hook",
+			Usage: "Shell `COMMAND` to run after the configuration is " +
+				"written; repeat for several hooks, run in order.",
+		},
+		&cli.BoolFlag{
+			Name:        "strict-hooks",
+			Destination: &runOptions.setupOptions.strictHooks,
+			Usage: "Fail and restore the previous configuration file " +
+				"if a post-setup hook fails.",
+		},
+		&cli.BoolFlag{
+			Name:        "detailed-exit-codes",
+			Destination: &runOptions.setupOptions.detailedExitCodes,
+			Usage: "Exit with code 3 instead of 0 when the configuration " +
+				"file is already up to date.",
+		},
+		&cli.BoolFlag{
+			Name:        "json-summary",
+			Destination: &runOptions.setupOptions.jsonSummary,
+			Usage: "Print a JSON summary of what setup did, " +
+				"also when it fails.",
+		},
+		&cli.BoolFlag{
+			Name:        "no-prompt",
+			Destination: &runOptions.setupOptions.noPrompt,
+			Usage: "Never prompt for input; fail if a required " +
+				"value is not given. Implied when stdin is not a terminal.",
+		},
+	}
+	for _, flag := range flags {
+		setupFlagEnvVar(flag)
+	}
+	return flags
+}
+
+// setupFlagEnvVar makes the flag readable from the environment variable
+// MENDER_SETUP_<NAME>, e.g. MENDER_SETUP_SERVER_URL for --server-url. A flag
+// given on the command line takes precedence over the environment variable,
+// which in turn takes precedence over the answers file.
+func setupFlagEnvVar(flag cli.Flag) {
+	envVar := setupEnvPrefix + strings.ToUpper(
+		strings.ReplaceAll(flag.Names()[0], "-", "_"))
+	switch f := flag.(type) {
+	case *cli.StringFlag:
+		f.EnvVars = append(f.EnvVars, envVar)
+		// The help text shows the value from the environment as the
+		// default, which must not reveal secrets.
+		if value, ok := os.LookupEnv(envVar); ok && secretSetupFlags[f.Name] {
+			f.DefaultText = maskSecret(value)
+		}
+	case *cli.BoolFlag:
+		f.EnvVars = append(f.EnvVars, envVar)
+	case *cli.IntFlag:
+		f.EnvVars = append(f.EnvVars, envVar)
+	case *cli.DurationFlag:
+		f.EnvVars = append(f.EnvVars, envVar)
+	case *cli.StringSliceFlag:
+		f.EnvVars = append(f.EnvVars, envVar)
+	}
+}
+
 func (runOptions *runOptionsType) commonCLIHandler(
 	ctx *cli.Context) (*conf.MenderConfig, error) {
 
-	fmt.Println("runOptions datastore: ", runOptions.dataStore)
+	fmt.Fprintln(userOutput, "runOptions datastore: ", runOptions.dataStore)
 
 	// Handle config flags
-	config, err := conf.LoadConfig(
-		runOptions.config, runOptions.fallbackConfig)
+	config, err := loadConfig(runOptions.config,
+		runOptions.fallbackConfig, runOptions.setupOptions.configFormat)
 	if err != nil {
 		return nil, err
 	}
+	logRedactor.addSecret(config.TenantToken)
 
 	// Make sure that paths that are not configurable via the config file is conconsistent with
 	// --data flag
@@ -268,8 +868,9 @@ func (runOptions *runOptionsType) commonCLIHandler(
 			runOptions.dataStore, "device_type")
 	}
 
-	// Skip verify for setup, as the configuration will be overridden
-	if ctx.Command.Name != "setup" {
+	// Skip verify for setup and reset, as the configuration will be
+	// overridden
+	if ctx.Command.Name != "setup" && ctx.Command.Name != "reset" {
 		err := config.Validate()
 		if err != nil {
 			return nil, err
@@ -292,47 +893,169 @@ func (runOptions *runOptionsType) handleCLIOptions(ctx *cli.Context) error {
 	// Execute commands
 	switch ctx.Command.Name {
 
-	case "setup":
-		// Check that user has permission to directories so that
-		// the user doesn't have to perform the setup before raising
-		// an error.
-		fmt.Println("runOptions config: ", runOptions.config)
-		fmt.Println("runOptions config: ", path.Dir(runOptions.config))
-		if err = checkWritePermissions(path.Dir(runOptions.config)); err != nil {
-			return err
+	case "setup", "reset":
+		err = runOptions.runSetup(ctx, config)
+
+	default:
+		cli.ShowAppHelpAndExit(ctx, 1)
+	}
+	return err
+}
+
+// checkSetupPermissions checks that user has permission to directories so
+// that the user doesn't have to perform the setup before raising an error.
+// A dry run does not write anything.
+func (runOptions *runOptionsType) checkSetupPermissions() error {
+	if runOptions.setupOptions.dryRun {
+		return nil
+	}
+	fmt.Fprintln(userOutput, "runOptions config: ", runOptions.config)
+	fmt.Fprintln(userOutput, "runOptions config: ", path.Dir(runOptions.config))
+	if err := checkWritePermissions(path.Dir(runOptions.config)); err != nil {
+		return errors.Errorf(errMsgConfigDirF,
+			runOptions.config, err.Error())
+	}
+	fmt.Fprintln(userOutput, "runOptions config datastore: ", runOptions.dataStore)
+	fmt.Fprintln(userOutput, "runOptions config datastore: ",
+		path.Dir(runOptions.dataStore))
+	return checkWritePermissions(runOptions.dataStore)
+}
+
+// runSetup runs the setup and reset commands.
+func (runOptions *runOptionsType) runSetup(ctx *cli.Context,
+	config *conf.MenderConfig) error {
+	if err := runOptions.checkSetupPermissions(); err != nil {
+		return err
+	}
+	if ctx.Command.Name == "reset" {
+		// Nothing is removed unless setup can run afterwards.
+		if err := runOptions.setupOptions.checkRequiredFlags(ctx,
+			runOptions.setupOptions.stdinPrompter()); err != nil {
+			return exitWithCode(err, exitCodeValidation)
 		}
-		fmt.Println("runOptions config datastore: ", runOptions.dataStore)
-		fmt.Println("runOptions config datastore: ", path.Dir(runOptions.dataStore))
-		if err = checkWritePermissions(runOptions.dataStore); err != nil {
+		if err := runOptions.resetDeviceState(ctx, config); err != nil {
 			return err
 		}
-		// Run cli setup prompts.
+	}
+	// Run cli setup prompts.
 
-		if err := doSetup(ctx, &config.MenderConfigFromFile,
-			&runOptions.setupOptions); err != nil {
-			return err
+	result, err := doSetup(ctx, &config.MenderConfigFromFile,
+		&runOptions.setupOptions)
+	if err == nil {
+		err = runOptions.finishSetup(ctx, config, result)
+	}
+	if runOptions.setupOptions.jsonSummary {
+		if pErr := printSetupResult(os.Stdout, result); pErr != nil && err == nil {
+			err = pErr
+		}
+	}
+	if err != nil {
+		return exitWithCode(err, failedStageExitCode(result.FailedStage))
+	}
+	return runOptions.setupExitStatus(ctx, result)
+}
+
+// finishSetup installs the files which go with the configuration, verifies
+// the authorization and runs the post setup hooks.
+func (runOptions *runOptionsType) finishSetup(ctx *cli.Context,
+	config *conf.MenderConfig, result *setupResult) error {
+	opts := &runOptions.setupOptions
+	if opts.dryRun {
+		return nil
+	}
+	if opts.systemdUnit {
+		if err := generateSystemdUnit(systemdUnitOptions{
+			Binary:     opts.menderBinary,
+			ConfigPath: runOptions.config,
+			DataStore:  runOptions.dataStore,
+		}, opts.systemdDir); err != nil {
+			return result.fail(setupStageSystemdUnit, err)
+		}
+	}
+	if opts.identitySource != "" {
+		if err := installIdentityScript(opts.identitySource,
+			opts.identityUUID, device.IdentityDataHelper); err != nil {
+			return result.fail(setupStageIdentity, err)
+		}
+	}
+	if len(opts.inventory) > 0 {
+		if err := installInventoryScript(opts.inventory,
+			inventoryScriptPath); err != nil {
+			return result.fail(setupStageInventory, err)
 		}
-		if !ctx.Bool("quiet") {
-			fmt.Println(promptDone)
+	}
+	if opts.verifyAuth {
+		w := userOutput
+		if ctx.Bool("quiet") {
+			w = ioutil.Discard
 		}
+		reqCtx, cancel := opts.networkContext()
+		result.Authorization = checkAuthorization(reqCtx, config,
+			runOptions.dataStore, w)
+		cancel()
+	}
+	if result.Written && len(opts.postHooks) > 0 {
+		return runOptions.postSetupHooks(result)
+	}
+	return nil
+}
 
-	default:
-		cli.ShowAppHelpAndExit(ctx, 1)
+// setupExitStatus tells the user whether the configuration changed, and
+// returns the exit code for no change with --detailed-exit-codes.
+func (runOptions *runOptionsType) setupExitStatus(ctx *cli.Context,
+	result *setupResult) error {
+	opts := &runOptions.setupOptions
+	if !ctx.Bool("quiet") && !opts.dryRun && !opts.jsonSummary {
+		if result.Written {
+			fmt.Fprintln(userOutput, promptDone)
+		} else {
+			fmt.Fprintln(userOutput, promptNoChanges)
+		}
 	}
-	return err
+	if opts.detailedExitCodes && !result.Written &&
+		(!result.DryRun || len(result.ChangedFields) == 0) {
+		return cli.Exit("", exitCodeNoChange)
+	}
+	return nil
 }
 
 func (runOptions *runOptionsType) setupCLIHandler(ctx *cli.Context) error {
 	if ctx.Args().Len() > 0 {
-		return errors.Errorf(
+		return exitWithCode(errors.Errorf(
 			errMsgAmbiguousArgumentsGivenF,
-			ctx.Args().First())
+			ctx.Args().First()), exitCodeValidation)
 	}
 	if !ctx.IsSet("log-level") {
-		log.SetLevel(log.WarnLevel)
+		if runOptions.setupOptions.traceHTTP {
+			log.SetLevel(log.DebugLevel)
+		} else {
+			log.SetLevel(log.WarnLevel)
+		}
+	}
+	if err := applyTenantTokenFile(ctx); err != nil {
+		return exitWithCode(err, exitCodeValidation)
+	}
+	if err := applyAnswersFile(ctx); err != nil {
+		return exitWithCode(err, exitCodeValidation)
 	}
 	if err := runOptions.setupOptions.handleImplicitFlags(ctx); err != nil {
-		return err
+		return exitWithCode(err, exitCodeValidation)
+	}
+	if runOptions.setupOptions.jsonSummary {
+		userOutput = os.Stderr
+	}
+	logRedactor.addSecret(runOptions.setupOptions.tenantToken)
+	logRedactor.addSecret(runOptions.setupOptions.password)
+	if err := validateConfigFormat(runOptions.setupOptions.configFormat); err != nil {
+		return exitWithCode(err, exitCodeValidation)
+	}
+	if err := validateOutputConfigFormat(runOptions.setupOptions.configFormat,
+		runOptions.setupOptions.configPath); err != nil {
+		return exitWithCode(err, exitCodeValidation)
+	}
+	if runOptions.setupOptions.secretsPath != "" {
+		// The existing secrets are loaded along with the configuration.
+		runOptions.fallbackConfig = runOptions.setupOptions.secretsPath
 	}
 
 	// Handle overlapping global flags
@@ -351,6 +1074,56 @@ func (runOptions *runOptionsType) setupCLIHandler(ctx *cli.Context) error {
 	return runOptions.handleCLIOptions(ctx)
 }
 
+func (runOptions *runOptionsType) dumpConfigCLIHandler(ctx *cli.Context) error {
+	if ctx.Args().Len() > 0 {
+		return errors.Errorf(
+			errMsgAmbiguousArgumentsGivenF,
+			ctx.Args().First())
+	}
+	if !ctx.IsSet("log-level") {
+		log.SetLevel(log.WarnLevel)
+	}
+	opts := &runOptions.setupOptions
+	if err := applyTenantTokenFile(ctx); err != nil {
+		return err
+	}
+	if err := applyAnswersFile(ctx); err != nil {
+		return err
+	}
+	if err := opts.handleImplicitFlags(ctx); err != nil {
+		return err
+	}
+	if err := validateConfigFormat(opts.configFormat); err != nil {
+		return err
+	}
+	outputFormat := ctx.String("output-format")
+	if err := validateConfigFormat(outputFormat); err != nil {
+		return err
+	}
+	if opts.secretsPath != "" {
+		runOptions.fallbackConfig = opts.secretsPath
+	}
+
+	config, err := loadConfig(opts.configPath,
+		runOptions.fallbackConfig, opts.configFormat)
+	if err != nil {
+		return err
+	}
+	logRedactor.addSecret(opts.tenantToken)
+	logRedactor.addSecret(config.TenantToken)
+	opts.applyFlagOverrides(ctx, &config.MenderConfigFromFile)
+	if !ctx.Bool("show-secrets") {
+		config.TenantToken = maskSecret(config.TenantToken)
+	}
+
+	data, err := marshalConfig(&config.MenderConfigFromFile, outputFormat)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.App.Writer, strings.TrimSuffix(string(data), "\n"))
+	return validateConfig(&config.MenderConfigFromFile)
+}
+
 func upgradeHelpPrinter(defaultPrinter func(w io.Writer, templ string, data interface{})) func(
 	w io.Writer, templ string, data interface{}) {
 	// Applies the ordinary help printer with column post processing
@@ -413,7 +1186,7 @@ func upgradeHelpPrinter(defaultPrinter func(w io.Writer, templ string, data inte
 }
 
 func checkWritePermissions(dir string) error {
-	fmt.Println("Checking the permissions for: ", dir)
+	fmt.Fprintln(userOutput, "Checking the permissions for: ", dir)
 	_, err := os.Stat(dir)
 	if os.IsNotExist(err) {
 		err := os.MkdirAll(dir, 0755)
@@ -0,0 +1,135 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender/client"
+)
+
+const (
+	// Default of --max-clock-skew
+	defaultMaxClockSkew = 5 * time.Minute
+
+	rspClockSkewF = "The device clock is %s %s the clock of the server " +
+		"(device: %s, server: %s). TLS certificates can not be verified " +
+		"with a wrong clock; set the time, for example with NTP."
+	rspClockBeforeCertF = "The device clock (%s) is earlier than the start " +
+		"of the validity of the server certificate (%s), so the device " +
+		"clock is most likely wrong; set the time, for example with NTP."
+	rspClockAfterCertF = "The device clock (%s) is later than the end of " +
+		"the validity of the server certificate (%s). Either the " +
+		"certificate has expired, or the device clock is wrong."
+)
+
+// dateRecordingRequester remembers the time given by the Date header of the
+// last response, along with the local time it was received, for
+// --check-clock.
+type dateRecordingRequester struct {
+	api        client.ApiRequester
+	serverTime time.Time
+	localTime  time.Time
+}
+
+func (d *dateRecordingRequester) Do(req *http.Request) (*http.Response, error) {
+	rsp, err := d.api.Do(req)
+	if err != nil {
+		return rsp, err
+	}
+	if date, dErr := http.ParseTime(rsp.Header.Get("Date")); dErr == nil {
+		d.serverTime = date
+		d.localTime = time.Now()
+	}
+	return rsp, nil
+}
+
+// warnClockSkew warns if the local clock differs from the server clock by more
+// than --max-clock-skew. The Date header has a resolution of a second, which
+// the threshold is expected to be well above.
+func (opts *setupOptionsType) warnClockSkew(localTime, serverTime time.Time) {
+	skew := localTime.Sub(serverTime)
+	direction := "ahead of"
+	if skew < 0 {
+		skew = -skew
+		direction = "behind"
+	}
+	if skew <= opts.maxClockSkew {
+		log.Debugf("The device clock is within %s of the server clock.",
+			skew.Round(time.Second))
+		return
+	}
+	log.Warnf(rspClockSkewF, skew.Round(time.Second), direction,
+		localTime.UTC().Format(time.RFC3339),
+		serverTime.UTC().Format(time.RFC3339))
+}
+
+// serverCertificate returns the certificate the server at serverURL presents.
+// It is not verified, it is only used to tell why the verification failed.
+func serverCertificate(ctx context.Context, serverURL string) (*x509.Certificate, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "443")
+	}
+	dialer := &tls.Dialer{Config: &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: true,
+	}}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("the server sent no certificate")
+	}
+	return certs[0], nil
+}
+
+// warnCertificateClock warns if the local time is outside the validity of the
+// server certificate, which is what a device without a working clock most
+// often runs into.
+func (opts *setupOptionsType) warnCertificateClock(serverURL string, now time.Time) {
+	ctx, cancel := opts.networkContext()
+	defer cancel()
+	cert, err := serverCertificate(ctx, serverURL)
+	if err != nil {
+		log.Debugf("Unable to get the certificate of %s: %s",
+			serverURL, err.Error())
+		return
+	}
+	nowText := now.UTC().Format(time.RFC3339)
+	if now.Before(cert.NotBefore) {
+		log.Warnf(rspClockBeforeCertF, nowText,
+			cert.NotBefore.UTC().Format(time.RFC3339))
+	} else if now.After(cert.NotAfter) {
+		log.Warnf(rspClockAfterCertF, nowText,
+			cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,483 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+	"gopkg.in/yaml.v3"
+
+	"github.com/mendersoftware/mender/conf"
+	"github.com/mendersoftware/mender/dbus"
+)
+
+const (
+	configFormatJSON = "json"
+	configFormatYAML = "yaml"
+	configFormatTOML = "toml"
+
+	errMsgInvalidConfigFormatF = "Invalid configuration format %q, " +
+		"must be one of {%q, %q, %q}"
+	errMsgClientConfigFormatF = "The client only reads JSON configuration " +
+		"files, refusing to write %q as %s"
+
+	// Backups are named <config file>.<timestamp>.bak, and the timestamp
+	// format, with fixed width nanoseconds, sorts in chronological order.
+	configBackupTimeFormat = "2006-01-02T15:04:05.000000000"
+	configBackupSuffix     = ".bak"
+	defaultMaxBackups      = 5
+
+	// The configuration may hold the tenant token.
+	defaultConfigMode = "0600"
+)
+
+func validateConfigFormat(format string) error {
+	switch format {
+	case configFormatJSON, configFormatYAML, configFormatTOML:
+		return nil
+	}
+	return errors.Errorf(errMsgInvalidConfigFormatF, format,
+		configFormatJSON, configFormatYAML, configFormatTOML)
+}
+
+// validateOutputConfigFormat refuses writing the configuration file of the
+// client, which only reads JSON, in any other format.
+func validateOutputConfigFormat(format, filename string) error {
+	if format != configFormatJSON &&
+		filepath.Clean(filename) == conf.DefaultConfFile {
+		return errors.Errorf(errMsgClientConfigFormatF, filename, format)
+	}
+	return nil
+}
+
+// loadConfig loads the main configuration file in the given format, and the
+// fallback configuration file, which is always JSON as the client reads it.
+// JSON files are handed over to the client's own loader, while the other
+// formats are converted to JSON and decoded into the very same structure.
+func loadConfig(mainConfigFile, fallbackConfigFile,
+	format string) (*conf.MenderConfig, error) {
+	if format == configFormatJSON {
+		return conf.LoadConfig(mainConfigFile, fallbackConfigFile)
+	}
+
+	config := conf.NewMenderConfig()
+	// If DBus is compiled in, enable it by default
+	if _, err := dbus.GetDBusAPI(); err == nil {
+		config.DBus.Enabled = true
+	}
+	if err := readConfigFile(&config.MenderConfigFromFile,
+		fallbackConfigFile, configFormatJSON); err != nil {
+		return nil, err
+	}
+	if err := readConfigFile(&config.MenderConfigFromFile,
+		mainConfigFile, format); err != nil {
+		return nil, err
+	}
+	if config.ArtifactVerifyKey != "" {
+		if len(config.ArtifactVerifyKeys) > 0 {
+			return nil, errors.New("both ArtifactVerifyKey and " +
+				"ArtifactVerifyKeys are set")
+		}
+		config.ArtifactVerifyKeys = append(config.ArtifactVerifyKeys,
+			config.ArtifactVerifyKey)
+		config.ArtifactVerifyKey = ""
+	}
+	return config, nil
+}
+
+// readConfigFile decodes the configuration file into config. A file which does
+// not exist is not considered an error.
+func readConfigFile(config *conf.MenderConfigFromFile,
+	fileName, format string) error {
+	if fileName == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		log.Debug("Configuration file does not exist: ", fileName)
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "Error reading configuration file")
+	}
+
+	if format == configFormatYAML {
+		var values interface{}
+		if err = yaml.Unmarshal(data, &values); err != nil {
+			return errors.Wrapf(err,
+				"Error parsing configuration file %q", fileName)
+		}
+		if values == nil {
+			// Empty file
+			return nil
+		}
+		if data, err = json.Marshal(values); err != nil {
+			return errors.Wrapf(err,
+				"Error parsing configuration file %q", fileName)
+		}
+	} else if format == configFormatTOML {
+		if data, err = tomlToJSON(data); err != nil {
+			return errors.Wrapf(err,
+				"Error parsing configuration file %q", fileName)
+		}
+	}
+	if err = json.Unmarshal(data, config); err != nil {
+		return errors.Wrapf(err,
+			"Error parsing configuration file %q", fileName)
+	}
+	return nil
+}
+
+// marshalConfig encodes the configuration in the given format, using the same
+// keys and field order as the JSON representation.
+func marshalConfig(config *conf.MenderConfigFromFile,
+	format string) ([]byte, error) {
+	return marshalConfigValue(config, format)
+}
+
+// marshalConfigValue encodes any configuration structure like marshalConfig.
+func marshalConfigValue(config interface{}, format string) ([]byte, error) {
+	configJSON, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return nil, errors.Wrap(err, "Error encoding configuration to JSON")
+	}
+	switch format {
+	case configFormatJSON:
+		return configJSON, nil
+
+	case configFormatYAML:
+		// JSON is valid YAML, so decoding it into a node tree keeps
+		// both the key names and their order.
+		var node yaml.Node
+		if err = yaml.Unmarshal(configJSON, &node); err != nil {
+			return nil, errors.Wrap(err,
+				"Error encoding configuration to YAML")
+		}
+		resetYAMLStyle(&node)
+		configYAML, err := yaml.Marshal(&node)
+		if err != nil {
+			return nil, errors.Wrap(err,
+				"Error encoding configuration to YAML")
+		}
+		return configYAML, nil
+
+	case configFormatTOML:
+		configTOML, err := jsonToTOML(configJSON)
+		if err != nil {
+			return nil, errors.Wrap(err,
+				"Error encoding configuration to TOML")
+		}
+		return configTOML, nil
+	}
+	return nil, validateConfigFormat(format)
+}
+
+// tomlToJSON converts a TOML document to JSON, so that it can be decoded like
+// the other formats.
+func tomlToJSON(data []byte) ([]byte, error) {
+	values := map[string]interface{}{}
+	if err := toml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	return json.Marshal(values)
+}
+
+// jsonToTOML converts a JSON object to a TOML document. TOML has no null, so
+// null values are left out, and the keys are sorted by the encoder.
+func jsonToTOML(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(tomlValue(values)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// tomlValue prepares a decoded JSON value for the TOML encoder.
+func tomlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if child == nil {
+				delete(v, key)
+			} else {
+				v[key] = tomlValue(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = tomlValue(child)
+		}
+	case json.Number:
+		// Integers must stay integers, since the client decodes them
+		// into integer fields.
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return value
+}
+
+// resetYAMLStyle drops the flow style and quoting inherited from the JSON
+// input, so that the node tree is encoded as block style YAML.
+func resetYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		resetYAMLStyle(child)
+	}
+}
+
+// configFileUnchanged reports whether the configuration file already holds
+// data. The contents are compared after parsing, so differences in key order
+// or formatting do not count as changes.
+func configFileUnchanged(filename string, data []byte,
+	format string) (bool, error) {
+	existingData, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "Error reading configuration file")
+	}
+	if format == configFormatTOML {
+		if existingData, err = tomlToJSON(existingData); err != nil {
+			// Rewrite a file which can not be parsed.
+			return false, nil
+		}
+		if data, err = tomlToJSON(data); err != nil {
+			return false, errors.Wrap(err, "Error parsing configuration")
+		}
+	}
+	// JSON is valid YAML, so this parses both formats.
+	var existing, updated interface{}
+	if err = yaml.Unmarshal(existingData, &existing); err != nil {
+		// Rewrite a file which can not be parsed.
+		return false, nil
+	}
+	if err = yaml.Unmarshal(data, &updated); err != nil {
+		return false, errors.Wrap(err, "Error parsing configuration")
+	}
+	return reflect.DeepEqual(existing, updated), nil
+}
+
+func writeConfigData(data []byte, filename string, mode os.FileMode) error {
+	f, err := os.OpenFile(
+		filename,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		mode,
+	) // for mode see MEN-3762
+	if err != nil {
+		return errors.Wrapf(err, "Error opening configuration file %q",
+			filename)
+	}
+	defer f.Close()
+
+	if _, err = f.Write(data); err != nil {
+		return errors.Wrapf(err, "Error writing to configuration file %q",
+			filename)
+	}
+	return ensureConfigFileMode(filename, mode)
+}
+
+// ensureConfigFileMode sets the permissions of the configuration file to mode.
+// The mode of an existing file is kept when it is opened for writing, and the
+// umask applies to a new one, so both are corrected here.
+func ensureConfigFileMode(filename string, mode os.FileMode) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return errors.Wrapf(err, "Error reading the permissions of %q",
+			filename)
+	}
+	if info.Mode().Perm() == mode {
+		return nil
+	}
+	if info.Mode().Perm()&^mode != 0 {
+		log.Warnf("The configuration file %q had the permissions %#o, "+
+			"changing them to %#o", filename, info.Mode().Perm(), mode)
+	}
+	if err = os.Chmod(filename, mode); err != nil {
+		return errors.Wrapf(err, "Error changing the permissions of %q",
+			filename)
+	}
+	return nil
+}
+
+// parseConfigMode parses the --config-mode flag, an octal permission mode.
+func parseConfigMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode&^0777 != 0 {
+		return 0, errors.Errorf("Invalid configuration file mode %q, "+
+			"expected octal permissions like %q", s, defaultConfigMode)
+	}
+	if mode&0004 != 0 {
+		log.Warnf("The configuration file will be readable by all "+
+			"users with mode %q, although it may hold secrets", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// backupConfigFile copies the existing configuration file to a timestamped
+// backup and returns its path, or an empty path if there is no existing file.
+// Only the newest maxBackups backups are kept, unless maxBackups is 0.
+func backupConfigFile(filename string, maxBackups int) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrap(err, "Error reading configuration file for backup")
+	}
+	backup, err := writeBackupFile(filename, data)
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Backed up configuration file to %q", backup)
+
+	if maxBackups > 0 {
+		backups, err := configBackups(filename)
+		if err != nil {
+			log.Warnf("Unable to list configuration backups: %s", err.Error())
+			return backup, nil
+		}
+		for len(backups) > maxBackups {
+			if err = os.Remove(backups[0]); err != nil {
+				log.Warnf("Unable to remove configuration backup %q: %s",
+					backups[0], err.Error())
+			}
+			backups = backups[1:]
+		}
+	}
+	return backup, nil
+}
+
+// configBackups returns the backups of filename made by backupConfigFile,
+// oldest first. Other files with the backup suffix, like a copy the user made
+// by hand, are left out, so that they are never removed.
+func configBackups(filename string) ([]string, error) {
+	matches, err := filepath.Glob(filename + ".*" + configBackupSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, match := range matches {
+		timestamp := strings.TrimSuffix(strings.TrimPrefix(match,
+			filename+"."), configBackupSuffix)
+		if _, err = time.Parse(configBackupTimeFormat, timestamp); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// writeBackupFile writes data to a new backup of filename, named after the
+// current time, and returns its path. An existing backup is never overwritten.
+func writeBackupFile(filename string, data []byte) (string, error) {
+	for now := time.Now().UTC(); ; now = now.Add(time.Nanosecond) {
+		backup := fmt.Sprintf("%s.%s%s", filename,
+			now.Format(configBackupTimeFormat), configBackupSuffix)
+		// The configuration may hold secrets, so keep the backup private.
+		f, err := os.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			// Made within the resolution of the clock, so take the
+			// next name, which still sorts after the existing one.
+			continue
+		} else if err != nil {
+			return "", errors.Wrapf(err,
+				"Error writing configuration backup %q", backup)
+		}
+		_, err = f.Write(data)
+		if cErr := f.Close(); err == nil {
+			err = cErr
+		}
+		if err != nil {
+			os.Remove(backup)
+			return "", errors.Wrapf(err,
+				"Error writing configuration backup %q", backup)
+		}
+		return backup, nil
+	}
+}
+
+// restoreConfigBackup puts the backup back in place of the configuration file.
+func restoreConfigBackup(backup, filename string) error {
+	data, err := ioutil.ReadFile(backup)
+	if err != nil {
+		return errors.Wrapf(err, "Error reading configuration backup %q",
+			backup)
+	}
+	if err = ioutil.WriteFile(filename, data, 0600); err != nil {
+		return errors.Wrapf(err, "Error restoring configuration backup %q",
+			backup)
+	}
+	return nil
+}
+
+// configFileDiff returns a unified diff between the configuration in filename
+// and config. Both are encoded the same way, so that only actual changes of
+// the configuration show up, and not differences in formatting. A missing file
+// is treated as an empty configuration.
+func configFileDiff(config *conf.MenderConfigFromFile,
+	filename, format string) (string, error) {
+	var oldData []byte
+	if _, err := os.Stat(filename); err == nil {
+		oldConfig := conf.MenderConfigFromFile{}
+		if err = readConfigFile(&oldConfig, filename, format); err != nil {
+			return "", err
+		}
+		if oldData, err = marshalConfig(&oldConfig, format); err != nil {
+			return "", err
+		}
+	}
+	newData, err := marshalConfig(config, format)
+	if err != nil {
+		return "", err
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(oldData) + "\n"),
+		B:        difflib.SplitLines(string(newData) + "\n"),
+		FromFile: filename,
+		ToFile:   filename + " (new)",
+		Context:  3,
+	})
+}
+
+// maskSecret hides all but the last few characters of a secret, so that it
+// can be recognized without being disclosed.
+func maskSecret(secret string) string {
+	const visible = 4
+	if len(secret) <= 2*visible {
+		return strings.Repeat("*", len(secret))
+	}
+	return strings.Repeat("*", 8) + secret[len(secret)-visible:]
+}
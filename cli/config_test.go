@@ -0,0 +1,162 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/conf"
+)
+
+// testConfig returns a configuration with the settings setup writes.
+func testConfig() *conf.MenderConfigFromFile {
+	return &conf.MenderConfigFromFile{
+		Servers: []client.MenderServer{
+			{ServerURL: "https://mender.example.com"},
+			{ServerURL: "https://fallback.example.com"},
+		},
+		ServerCertificate: "/etc/mender/server.crt",
+		TenantToken:       "tenant.token.value",
+		HttpsClient: client.HttpsClient{
+			Certificate: "/etc/mender/client.crt",
+			Key:         "/etc/mender/client.key",
+		},
+		Connectivity: client.Connectivity{
+			DisableKeepAlive:       true,
+			IdleConnTimeoutSeconds: 30,
+		},
+		ArtifactVerifyKeys: []string{
+			"/etc/mender/artifact-a.key",
+			"/etc/mender/artifact-b.key",
+		},
+		RootfsPartA:                               "/dev/mmcblk0p2",
+		RootfsPartB:                               "/dev/mmcblk0p3",
+		DeviceTypeFile:                            "/var/lib/mender/device_type",
+		UpdatePollIntervalSeconds:                 1800,
+		InventoryPollIntervalSeconds:              28800,
+		RetryPollIntervalSeconds:                  300,
+		UpdateControlMapExpirationTimeSeconds:     3600,
+		UpdateControlMapBootExpirationTimeSeconds: 600,
+	}
+}
+
+func TestConfigLoadedByClient(t *testing.T) {
+	config := testConfig()
+	data, err := marshalConfig(config, configFormatJSON)
+	assert.NoError(t, err)
+	filename := filepath.Join(t.TempDir(), "mender.conf")
+	assert.NoError(t, ioutil.WriteFile(filename, data, 0600))
+
+	loaded, err := conf.LoadConfig(filename, "")
+	assert.NoError(t, err)
+	assert.Equal(t, *config, loaded.MenderConfigFromFile)
+}
+
+func TestValidateOutputConfigFormat(t *testing.T) {
+	for _, format := range []string{configFormatYAML, configFormatTOML} {
+		assert.Error(t, validateOutputConfigFormat(format,
+			conf.DefaultConfFile))
+		assert.NoError(t, validateOutputConfigFormat(format,
+			"/etc/mender/mender."+format))
+	}
+	assert.NoError(t, validateOutputConfigFormat(configFormatJSON,
+		conf.DefaultConfFile))
+}
+
+func TestConfigFormatRoundTrip(t *testing.T) {
+	for _, format := range []string{
+		configFormatJSON, configFormatYAML, configFormatTOML,
+	} {
+		config := testConfig()
+		data, err := marshalConfig(config, format)
+		assert.NoError(t, err, format)
+		filename := filepath.Join(t.TempDir(), "mender."+format)
+		assert.NoError(t, ioutil.WriteFile(filename, data, 0600))
+
+		loaded, err := loadConfig(filename, "", format)
+		assert.NoError(t, err, format)
+		assert.Equal(t, *config, loaded.MenderConfigFromFile, format)
+	}
+}
+
+func TestConfigFileMode(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mender.conf")
+	fileMode := func() os.FileMode {
+		info, err := os.Stat(filename)
+		assert.NoError(t, err)
+		return info.Mode().Perm()
+	}
+
+	// A new file gets the mode, whatever the umask.
+	mode, err := parseConfigMode(defaultConfigMode)
+	assert.NoError(t, err)
+	assert.NoError(t, writeConfigData([]byte("{}"), filename, mode))
+	assert.Equal(t, os.FileMode(0600), fileMode())
+
+	// An existing file keeps its mode when written, unless corrected.
+	assert.NoError(t, os.Chmod(filename, 0644))
+	assert.NoError(t, writeConfigData([]byte("{}"), filename, mode))
+	assert.Equal(t, os.FileMode(0600), fileMode())
+	assert.NoError(t, os.Chmod(filename, 0644))
+	assert.NoError(t, ensureConfigFileMode(filename, mode))
+	assert.Equal(t, os.FileMode(0600), fileMode())
+
+	mode, err = parseConfigMode("0640")
+	assert.NoError(t, err)
+	assert.NoError(t, writeConfigData([]byte("{}"), filename, mode))
+	assert.Equal(t, os.FileMode(0640), fileMode())
+
+	for _, invalid := range []string{"", "rw-------", "0800", "1777"} {
+		_, err = parseConfigMode(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestBackupConfigFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mender.conf")
+	backup, err := backupConfigFile(filename, 3)
+	assert.NoError(t, err)
+	assert.Empty(t, backup, "no backup without a configuration file")
+
+	// Not made by setup, so never removed.
+	userBackup := filename + ".orig" + configBackupSuffix
+	assert.NoError(t, ioutil.WriteFile(userBackup, []byte("orig"), 0600))
+
+	// Backups made in quick succession get names of their own, and only
+	// the newest ones are kept.
+	var backups []string
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, ioutil.WriteFile(filename,
+			[]byte(strconv.Itoa(i)), 0600))
+		backup, err = backupConfigFile(filename, 3)
+		assert.NoError(t, err)
+		backups = append(backups, backup)
+	}
+	kept, err := configBackups(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, backups[7:], kept)
+	assert.FileExists(t, userBackup)
+	for i, backup := range kept {
+		data, err := ioutil.ReadFile(backup)
+		assert.NoError(t, err)
+		assert.Equal(t, strconv.Itoa(7+i), string(data))
+	}
+}
@@ -0,0 +1,462 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender/client"
+)
+
+const (
+	// Any Mender server answers this endpoint; without a device token
+	// the expected response is 401 Unauthorized.
+	connectivityCheckEndpoint = "/api/devices/v1/deployments/device/deployments/next"
+
+	rspConnectivityFailed = "\nUnable to verify the connection to the " +
+		"Mender Server at %s:\n\t%s\n"
+	promptConnectivityProceed = "Do you want to save the configuration " +
+		"anyway? [y/N] "
+	errMsgConnectivityAborted = "Setup aborted: Mender Server is not reachable"
+	errMsgTimeoutF            = "%s timed out after %s"
+
+	defaultNetworkTimeout = 30 * time.Second
+)
+
+const (
+	// Backoff of --wait-reachable between the connectivity checks
+	waitReachableInitialDelay = time.Second
+	waitReachableMaxDelay     = 30 * time.Second
+
+	rspWaitingForServerF = "The Mender Server at %s is not reachable " +
+		"yet, retrying in %s: %s"
+	rspProceedUnreachable = "The Mender Server is not reachable; saving " +
+		"the configuration anyway as --wait-reachable-optional is given."
+	errMsgWaitInterrupted = "Setup aborted: interrupted while waiting " +
+		"for the Mender Server"
+)
+
+var errWaitInterrupted = errors.New(errMsgWaitInterrupted)
+
+const rspPollBelowServerMinimumF = "The %s poll interval of %d seconds is " +
+	"shorter than the %d seconds the server asked to wait between " +
+	"requests, so the device is likely to be throttled."
+
+// httpConfig returns the client configuration matching the server options.
+func (opts *setupOptionsType) httpConfig() client.Config {
+	config := client.Config{ServerCert: opts.serverCert}
+	if opts.demoServer && !opts.hostedMender {
+		config.ServerCert = getMenderDemoCertPath()
+	}
+	if opts.clientCert != "" {
+		config.HttpsClient = &client.HttpsClient{
+			Certificate: opts.clientCert,
+			Key:         opts.clientKey,
+			SSLEngine:   opts.sslEngine,
+		}
+	}
+	if opts.disableKeepAlive || opts.idleConnTimeout != 0 {
+		config.Connectivity = &client.Connectivity{
+			DisableKeepAlive:       opts.disableKeepAlive,
+			IdleConnTimeoutSeconds: opts.idleConnTimeout,
+		}
+	}
+	return config
+}
+
+// dialFunc is the type of http.Transport.DialContext.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// tuneTransport applies the dial options of setup to the transport of
+// httpClient, keeping the dialer already set up, e.g. with keepalive.
+func (opts *setupOptionsType) tuneTransport(httpClient *http.Client) {
+	if !opts.preferIPv4 && opts.connectTimeout <= 0 {
+		return
+	}
+	if httpClient.Transport == nil {
+		httpClient.Transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	transport, ok := httpClient.Transport.(*http.Transport)
+	if !ok {
+		log.Warn("Unable to apply the connection options: unknown " +
+			"HTTP transport")
+		return
+	}
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	if opts.preferIPv4 {
+		dial = preferIPv4Dialer(dial)
+		if transport.DialTLS != nil {
+			// The OpenSSL dialer of the client resolves the server
+			// itself, and can't be told to prefer IPv4.
+			log.Warn("--prefer-ipv4 does not apply to the HTTPS " +
+				"connections of the connectivity check")
+		}
+	}
+	if opts.connectTimeout > 0 {
+		dial = timeoutDialer(dial, opts.connectTimeout)
+		transport.TLSHandshakeTimeout = opts.connectTimeout
+		if transport.DialTLS != nil {
+			transport.DialTLS = timeoutDialTLS(transport.DialTLS,
+				opts.connectTimeout)
+		}
+	}
+	transport.DialContext = dial
+}
+
+// timeoutDialTLS is timeoutDialer for the OpenSSL dialer of the client, which
+// connects and does the TLS handshake in one go, and can't be cancelled. A
+// connection made after the timeout is closed.
+func timeoutDialTLS(dialTLS func(network, addr string) (net.Conn, error),
+	timeout time.Duration) func(network, addr string) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	return func(network, addr string) (net.Conn, error) {
+		done := make(chan dialResult, 1)
+		go func() {
+			conn, err := dialTLS(network, addr)
+			done <- dialResult{conn, err}
+		}()
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case result := <-done:
+			return result.conn, result.err
+		case <-timer.C:
+			go func() {
+				if result := <-done; result.conn != nil {
+					result.conn.Close()
+				}
+			}()
+			return nil, errors.Errorf("Connecting to %s timed out "+
+				"after %s", addr, timeout)
+		}
+	}
+}
+
+// timeoutDialer returns a dial function giving up on every connection attempt
+// of dial after timeout, for --connect-timeout. The time spent reading the
+// response is only bounded by --timeout.
+func timeoutDialer(dial dialFunc, timeout time.Duration) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		conn, err := dial(ctx, network, addr)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, errors.Wrapf(err, "Connecting to %s timed out "+
+				"after %s", addr, timeout)
+		}
+		return conn, err
+	}
+}
+
+// preferIPv4Dialer returns a dial function which connects over IPv4 if
+// possible, and only falls back to dial, with any address family, if that
+// fails. On dual-stack hosts with broken IPv6 this avoids waiting for the IPv6
+// connection attempts to time out.
+func preferIPv4Dialer(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network != "tcp" {
+			return dial(ctx, network, addr)
+		}
+		conn, err := dial(ctx, "tcp4", addr)
+		if err == nil {
+			return conn, nil
+		}
+		log.Debugf("Unable to connect to %s over IPv4, trying any address "+
+			"family: %s", addr, err.Error())
+		return dial(ctx, network, addr)
+	}
+}
+
+// timeoutContext returns a context bounded by timeout, or without a deadline
+// if timeout is not positive.
+func timeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// timeoutError names the operation when err is caused by a deadline of
+// timeout, and returns any other error as it is.
+func timeoutError(err error, operation string, timeout time.Duration) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errors.Errorf(errMsgTimeoutF, operation, timeout)
+	}
+	return err
+}
+
+// networkContext returns a context bounded by the --timeout deadline, which
+// all the network operations of setup use.
+func (opts *setupOptionsType) networkContext() (context.Context, context.CancelFunc) {
+	return timeoutContext(opts.timeout)
+}
+
+// timeoutError names the operation when err is caused by the --timeout
+// deadline, and returns any other error as it is.
+func (opts *setupOptionsType) timeoutError(err error, operation string) error {
+	return timeoutError(err, operation, opts.timeout)
+}
+
+// rateLimitedError is returned by probeServer when the server rejects the
+// request as too frequent.
+type rateLimitedError struct {
+	retryAfter time.Duration // zero if the server does not tell
+}
+
+func (e *rateLimitedError) Error() string {
+	if e.retryAfter <= 0 {
+		return "The server is rate limiting the requests"
+	}
+	return fmt.Sprintf("The server is rate limiting the requests, "+
+		"retry after %s", e.retryAfter)
+}
+
+// parseRetryAfter returns the duration of a Retry-After header, which is
+// either a number of seconds or an HTTP date, or zero if it is not valid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// warnServerPollMinimum warns about the poll intervals shorter than the wait
+// the server asked for in the connectivity check. This only informs the user,
+// the intervals are kept.
+func (opts *setupOptionsType) warnServerPollMinimum() {
+	minimum := int((opts.serverRetryAfter + time.Second - 1) / time.Second)
+	if minimum <= 0 {
+		return
+	}
+	for _, interval := range []struct {
+		name  string
+		value int
+	}{
+		{"update", opts.updatePollInterval},
+		{"inventory", opts.invPollInterval},
+	} {
+		if interval.value > 0 && interval.value < minimum {
+			log.Warnf(rspPollBelowServerMinimumF, interval.name,
+				interval.value, minimum)
+		}
+	}
+}
+
+// probeServer sends a single unauthenticated request to the server and returns
+// an error if the server can not be reached or gives an unexpected response.
+func probeServer(ctx context.Context, api client.ApiRequester, serverURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(serverURL, "/")+connectivityCheckEndpoint, nil)
+	if err != nil {
+		return errors.Wrap(err, "Error creating connectivity check request")
+	}
+	rsp, err := api.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Connectivity check request FAILED")
+	}
+	defer rsp.Body.Close()
+
+	switch rsp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusUnauthorized:
+		return nil
+	case http.StatusTooManyRequests:
+		return &rateLimitedError{
+			retryAfter: parseRetryAfter(rsp.Header.Get("Retry-After"),
+				time.Now()),
+		}
+	}
+	return errors.Errorf("Unexpected statuscode %d from connectivity "+
+		"check request", rsp.StatusCode)
+}
+
+// probeUntilReachable runs probeServer until the server is reachable, or until
+// --wait-reachable has passed, waiting longer after every failure. Errors
+// which retrying does not fix, like an untrusted certificate, are returned at
+// once. errWaitInterrupted is returned if ctx is cancelled while waiting.
+func (opts *setupOptionsType) probeUntilReachable(ctx context.Context,
+	api client.ApiRequester, serverURL string) error {
+	deadline := time.Now().Add(opts.waitReachable)
+	delay := waitReachableInitialDelay
+	for {
+		probeCtx, cancel := opts.networkContext()
+		err := probeServer(probeCtx, api, serverURL)
+		cancel()
+		var rateLimited *rateLimitedError
+		remaining := time.Until(deadline)
+		if err == nil || errors.As(err, &rateLimited) ||
+			isCertificateError(err) || remaining <= 0 {
+			return err
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		log.Infof(rspWaitingForServerF, serverURL,
+			delay.Round(time.Second), err.Error())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return errWaitInterrupted
+		}
+		if delay *= 2; delay > waitReachableMaxDelay {
+			delay = waitReachableMaxDelay
+		}
+	}
+}
+
+// warnServerClock warns if the clock of the device looks wrong, judged by the
+// time of the server or by a certificate error.
+func (opts *setupOptionsType) warnServerClock(
+	requester *dateRecordingRequester, serverURL string, err error) {
+	if !requester.serverTime.IsZero() {
+		opts.warnClockSkew(requester.localTime, requester.serverTime)
+	} else if err != nil && isCertificateError(err) &&
+		strings.HasPrefix(serverURL, "https://") {
+		opts.warnCertificateClock(serverURL, time.Now())
+	}
+}
+
+// checkServerURL probes serverURL and tells the user the result. It returns
+// whether the server is reachable, and errWaitInterrupted if ctx is cancelled
+// while waiting for it.
+func (opts *setupOptionsType) checkServerURL(ctx context.Context,
+	api client.ApiRequester, serverURL string) (bool, error) {
+	requester := &dateRecordingRequester{api: opts.requester(api)}
+	err := opts.probeUntilReachable(ctx, requester, serverURL)
+	if err == errWaitInterrupted {
+		return false, err
+	}
+	if opts.checkClock {
+		opts.warnServerClock(requester, serverURL, err)
+	}
+	var rateLimited *rateLimitedError
+	if errors.As(err, &rateLimited) {
+		// The server is reachable, but asks for fewer
+		// requests, which the poll intervals should honour.
+		log.Infof("The Mender Server at %s is reachable: %s",
+			serverURL, err.Error())
+		if rateLimited.retryAfter > opts.serverRetryAfter {
+			opts.serverRetryAfter = rateLimited.retryAfter
+		}
+		err = nil
+	}
+	if err != nil {
+		err = opts.timeoutError(err, "Connectivity check of "+serverURL)
+		fmt.Fprintf(userOutput, rspConnectivityFailed, serverURL, err.Error())
+		if isCertificateError(err) && opts.serverCert == "" {
+			fmt.Fprintln(userOutput, rspSuggestServerCert)
+		}
+		return false, nil
+	}
+	log.Infof("Successfully connected to the Mender "+
+		"Server at %s.", serverURL)
+	return true, nil
+}
+
+// checkConnectivity verifies that the configured server is reachable, and asks
+// the user whether to continue if it is not. It returns the result of the
+// check, one of the connectivity* constants.
+func (opts *setupOptionsType) checkConnectivity(stdin prompter) (string, error) {
+	if opts.demoServer && !opts.hostedMender {
+		// The host lookup for the demo server is not added until the
+		// configuration is saved.
+		log.Debug("Skipping connectivity check for the demo server.")
+		return connectivitySkipped, nil
+	}
+
+	httpConfig := opts.httpConfig()
+	if opts.serverCertPEM != nil {
+		// A pasted certificate is not written until the configuration
+		// is saved, so use a temporary copy for the check.
+		certFile, err := ioutil.TempFile("", "mender-server-cert")
+		if err != nil {
+			return connectivityFailed, errors.Wrap(err,
+				"Unable to create temporary file")
+		}
+		defer os.Remove(certFile.Name())
+		_, err = certFile.Write(opts.serverCertPEM)
+		certFile.Close()
+		if err != nil {
+			return connectivityFailed, errors.Wrap(err,
+				"Unable to write temporary file")
+		}
+		httpConfig.ServerCert = certFile.Name()
+	}
+
+	waitCtx := context.Background()
+	if opts.waitReachable > 0 {
+		// Catch the signals while waiting, so that setup stops cleanly
+		// instead of being killed.
+		var stop context.CancelFunc
+		waitCtx, stop = signal.NotifyContext(waitCtx, os.Interrupt,
+			syscall.SIGTERM)
+		defer stop()
+	}
+
+	failed := false
+	if api, err := client.NewApiClient(httpConfig); err != nil {
+		fmt.Fprintf(userOutput, rspConnectivityFailed, opts.serverURL, err.Error())
+		failed = true
+	} else {
+		opts.tuneTransport(&api.Client)
+		for _, serverURL := range opts.serverURLs() {
+			reachable, err := opts.checkServerURL(waitCtx, api, serverURL)
+			if err != nil {
+				return connectivityFailed, err
+			}
+			failed = failed || !reachable
+		}
+	}
+	if !failed {
+		return connectivityOK, nil
+	}
+	if opts.waitOptional {
+		log.Warn(rspProceedUnreachable)
+		return connectivityFailed, nil
+	}
+
+	proceed, err := stdin.promptYN(promptConnectivityProceed, false)
+	if err != nil {
+		return connectivityFailed, err
+	}
+	if !proceed {
+		return connectivityFailed, errors.New(errMsgConnectivityAborted)
+	}
+	return connectivityFailed, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender/client"
+)
+
+func TestKeepAliveOptions(t *testing.T) {
+	opts := &setupOptionsType{
+		serverURL:        "https://mender.example.com",
+		disableKeepAlive: true,
+		idleConnTimeout:  42,
+		connectTimeout:   5 * time.Second,
+	}
+
+	// The transport of the connectivity check.
+	api, err := client.NewApiClient(opts.httpConfig())
+	assert.NoError(t, err)
+	opts.tuneTransport(&api.Client)
+	transport := api.Client.Transport.(*http.Transport)
+	assert.True(t, transport.DisableKeepAlives)
+	assert.Equal(t, 42*time.Second, transport.IdleConnTimeout)
+
+	// The transport of the client, from the configuration file.
+	loaded := loadWrittenConfig(t, opts)
+	api, err = client.NewApiClient(loaded.GetHttpConfig())
+	assert.NoError(t, err)
+	transport = api.Client.Transport.(*http.Transport)
+	assert.True(t, transport.DisableKeepAlives)
+	assert.Equal(t, 42*time.Second, transport.IdleConnTimeout)
+}
+
+func TestPreferIPv4Dialer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	// The dialer of the transport is kept, and asked for IPv4 first.
+	var networks []string
+	dialer := &net.Dialer{}
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network,
+			addr string) (net.Conn, error) {
+			networks = append(networks, network)
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+	opts := &setupOptionsType{preferIPv4: true}
+	opts.tuneTransport(httpClient)
+	rsp, err := httpClient.Get("http://localhost:" + port)
+	if assert.NoError(t, err) {
+		rsp.Body.Close()
+	}
+	assert.Equal(t, []string{"tcp4"}, networks)
+
+	// Other address families are tried if IPv4 fails.
+	var fallback []string
+	dial := preferIPv4Dialer(func(ctx context.Context, network,
+		addr string) (net.Conn, error) {
+		fallback = append(fallback, network)
+		if network == "tcp4" {
+			return nil, errors.New("network is unreachable")
+		}
+		return dialer.DialContext(ctx, network, addr)
+	})
+	conn, err := dial(context.Background(), "tcp", "localhost:"+port)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Equal(t, []string{"tcp4", "tcp"}, fallback)
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// A server accepting connections, but never completing the TLS
+	// handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	// With a server certificate, the client dials with OpenSSL.
+	serverCert, _ := writeTestKeyPair(t, t.TempDir(), "server")
+	opts := &setupOptionsType{
+		serverURL:      "https://" + listener.Addr().String(),
+		serverCert:     serverCert,
+		connectTimeout: 200 * time.Millisecond,
+	}
+	api, err := client.NewApiClient(opts.httpConfig())
+	assert.NoError(t, err)
+	assert.NotNil(t, api.Client.Transport.(*http.Transport).DialTLS)
+	opts.tuneTransport(&api.Client)
+	req, err := http.NewRequest(http.MethodGet, opts.serverURL, nil)
+	assert.NoError(t, err)
+	start := time.Now()
+	_, err = api.Do(req)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
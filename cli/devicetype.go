@@ -0,0 +1,199 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+
+	"github.com/mendersoftware/mender/device"
+)
+
+const (
+	listDeviceTypesDescription = "Prints candidate device types for this " +
+		"device, read from the existing device type files and from the " +
+		"hardware description in the device tree and DMI. With " +
+		"--server-url and --admin-token, the device types of the devices " +
+		"in the server inventory are listed as well. Nothing is written."
+
+	// Query for the devices in the inventory, with their attributes.
+	inventoryDevicesEndpoint = "/api/management/v1/inventory/devices?per_page=500"
+
+	rspDeviceTypeCandidateF = "%-30s %s\n"
+	rspNoDeviceTypes        = "No device type candidates found."
+)
+
+// hardwareModelFiles describe the hardware, in order of preference.
+var hardwareModelFiles = []string{
+	"/proc/device-tree/model",
+	"/sys/class/dmi/id/product_name",
+	"/sys/class/dmi/id/board_name",
+}
+
+// deviceTypeCandidate is a device type, and where it was found.
+type deviceTypeCandidate struct {
+	deviceType string
+	source     string
+}
+
+var invalidDeviceTypeChars = regexp.MustCompile("[^a-z0-9_]+")
+
+// deviceTypeFromModel turns a hardware model name into a valid device type,
+// e.g. "Raspberry Pi 4 Model B" into "raspberry-pi-4-model-b".
+func deviceTypeFromModel(model string) string {
+	model = strings.ToLower(strings.Trim(model, "\x00 \n"))
+	return strings.Trim(invalidDeviceTypeChars.ReplaceAllString(model, "-"), "-")
+}
+
+// localDeviceTypeCandidates returns the valid device types in the device type
+// files, followed by the ones made from the hardware description.
+func localDeviceTypeCandidates(deviceTypeFiles []string) []deviceTypeCandidate {
+	validDeviceRegex := regexp.MustCompile(validDeviceRegularExpression)
+	var candidates []deviceTypeCandidate
+	seen := map[string]bool{}
+	add := func(deviceType, source string) {
+		if !seen[deviceType] {
+			seen[deviceType] = true
+			candidates = append(candidates,
+				deviceTypeCandidate{deviceType, source})
+		}
+	}
+	for _, deviceTypeFile := range deviceTypeFiles {
+		fileDevType, err := device.GetDeviceType(deviceTypeFile)
+		if err == nil && validDeviceRegex.MatchString(fileDevType) {
+			add(fileDevType, deviceTypeFile)
+		} else if err == nil {
+			log.Warnf("Ignoring invalid device type %q in %q",
+				fileDevType, deviceTypeFile)
+		}
+	}
+	for _, modelFile := range hardwareModelFiles {
+		model, err := ioutil.ReadFile(modelFile)
+		if err != nil {
+			log.Debugf("No hardware model in %q: %s", modelFile, err.Error())
+			continue
+		}
+		if deviceType := deviceTypeFromModel(string(model)); deviceType != "" {
+			add(deviceType, modelFile)
+		}
+	}
+	return candidates
+}
+
+// serverDeviceTypes returns the device types of the devices in the inventory
+// of the server, the most common first. The token must be a user token
+// allowed to read the inventory.
+func serverDeviceTypes(ctx context.Context, serverURL, token string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(serverURL, "/")+inventoryDevicesEndpoint, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating inventory request")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("User-Agent", defaultUserAgent())
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Inventory request FAILED")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Unexpected statuscode %d from "+
+			"inventory request", rsp.StatusCode)
+	}
+
+	var devices []struct {
+		Attributes []struct {
+			Name  string      `json:"name"`
+			Value interface{} `json:"value"`
+		} `json:"attributes"`
+	}
+	if err = json.NewDecoder(rsp.Body).Decode(&devices); err != nil {
+		return nil, errors.Wrap(err, "Error parsing inventory response")
+	}
+	counts := map[string]int{}
+	for _, dev := range devices {
+		for _, attr := range dev.Attributes {
+			if deviceType, ok := attr.Value.(string); ok &&
+				attr.Name == "device_type" {
+				counts[deviceType]++
+			}
+		}
+	}
+	deviceTypes := make([]string, 0, len(counts))
+	for deviceType := range counts {
+		deviceTypes = append(deviceTypes, deviceType)
+	}
+	sort.Slice(deviceTypes, func(i, j int) bool {
+		if counts[deviceTypes[i]] != counts[deviceTypes[j]] {
+			return counts[deviceTypes[i]] > counts[deviceTypes[j]]
+		}
+		return deviceTypes[i] < deviceTypes[j]
+	})
+	return deviceTypes, nil
+}
+
+func listDeviceTypesCLIHandler(ctx *cli.Context) error {
+	if ctx.Args().Len() > 0 {
+		return errors.Errorf(
+			errMsgAmbiguousArgumentsGivenF,
+			ctx.Args().First())
+	}
+	if !ctx.IsSet("log-level") {
+		log.SetLevel(log.WarnLevel)
+	}
+	candidates := localDeviceTypeCandidates([]string{
+		ctx.String("device-type-file"),
+		path.Join(ctx.String("data"), "device_type"),
+	})
+
+	if serverURL, token := ctx.String("server-url"),
+		ctx.String("admin-token"); serverURL != "" && token != "" {
+		logRedactor.addSecret(token)
+		reqCtx, cancel := context.WithTimeout(context.Background(),
+			ctx.Duration("timeout"))
+		deviceTypes, err := serverDeviceTypes(reqCtx, serverURL, token)
+		cancel()
+		if err != nil {
+			// The local candidates are still useful.
+			log.Warnf("Unable to list the device types in the server "+
+				"inventory: %s", err.Error())
+		}
+		for _, deviceType := range deviceTypes {
+			candidates = append(candidates,
+				deviceTypeCandidate{deviceType, serverURL})
+		}
+	}
+
+	if len(candidates) == 0 {
+		fmt.Fprintln(ctx.App.Writer, rspNoDeviceTypes)
+		return nil
+	}
+	for _, candidate := range candidates {
+		fmt.Fprintf(ctx.App.Writer, rspDeviceTypeCandidateF,
+			candidate.deviceType, candidate.source)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"github.com/urfave/cli/v2"
+)
+
+// Exit codes of setup. Automation relies on them, so they must not change.
+const (
+	exitCodeOK           = 0 // the configuration is written, or up to date
+	exitCodeError        = 1 // any other error
+	exitCodeNoChange     = 3 // with --detailed-exit-codes: nothing to write
+	exitCodeValidation   = 4 // invalid or missing options
+	exitCodeConnectivity = 5 // the server is not reachable
+)
+
+// exitWithCode returns err so that setup exits with code, or nil if err is nil.
+func exitWithCode(err error, code int) error {
+	if err == nil {
+		return nil
+	}
+	return cli.Exit(err.Error(), code)
+}
+
+// failedStageExitCode returns the exit code for a setup run failing in stage.
+func failedStageExitCode(stage string) int {
+	switch stage {
+	case setupStagePrompt, setupStageValidate:
+		return exitCodeValidation
+	case setupStageConnectivity:
+		return exitCodeConnectivity
+	}
+	return exitCodeError
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+// exitCode returns the code setup exits with for err.
+func exitCode(err error) int {
+	if err == nil {
+		return exitCodeOK
+	}
+	var exitErr cli.ExitCoder
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return exitCodeError
+}
+
+func TestSetupExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "mender.conf")
+	args := []string{"--config", configFile,
+		"--data", dir, "--quiet", "--device-type", "raspberrypi4",
+		"--update-poll", "1800", "--inventory-poll", "28800",
+		"--retry-poll", "300"}
+
+	// An invalid answer, and no valid one to follow.
+	stdin := &scriptedPrompter{answers: []string{"raspberry pi"}}
+	err := runScriptedSetup(stdin, "--config", configFile, "--data", dir,
+		"--quiet", "--skip-connectivity-check")
+	assert.Equal(t, exitCodeValidation, exitCode(err), "%v", err)
+	// Asked again for the device type.
+	assert.Len(t, stdin.prompts, 2)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+	stdin = &scriptedPrompter{answers: []string{
+		"",  // server certificate
+		"",  // client certificate
+		"n", // proxy
+		"n", // proceed without connectivity
+	}}
+	err = runScriptedSetup(stdin, append(args, "--server-url", server.URL)...)
+	assert.Equal(t, exitCodeConnectivity, exitCode(err),
+		"%v, prompts: %q", err, stdin.prompts)
+	assert.Empty(t, stdin.answers)
+
+	args = append(args, "--server-url", "https://mender.example.com",
+		"--skip-connectivity-check", "--detailed-exit-codes")
+	answers := []string{
+		"",  // server certificate
+		"",  // client certificate
+		"n", // proxy
+	}
+	stdin = &scriptedPrompter{answers: append([]string{}, answers...)}
+	err = runScriptedSetup(stdin, args...)
+	assert.Equal(t, exitCodeOK, exitCode(err),
+		"%v, prompts: %q", err, stdin.prompts)
+	stdin = &scriptedPrompter{answers: append([]string{}, answers...)}
+	err = runScriptedSetup(stdin, args...)
+	assert.Equal(t, exitCodeNoChange, exitCode(err),
+		"%v, prompts: %q", err, stdin.prompts)
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"io"
+	"os"
+	"os/exec"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Environment of the post-setup hooks
+	hookEnvConfigPath = "MENDER_SETUP_CONFIG_PATH"
+	hookEnvSummary    = "MENDER_SETUP_SUMMARY"
+
+	errMsgPostHookF = "Post-setup hook %q FAILED: %s"
+)
+
+// postSetupHooks runs the post-setup hooks once the configuration is written.
+// A failed hook is reported in the summary, and only fails setup, after
+// rolling back the configuration file, with --strict-hooks.
+func (runOptions *runOptionsType) postSetupHooks(result *setupResult) error {
+	opts := &runOptions.setupOptions
+	// The output of the hooks must not end up in the JSON summary.
+	errs := runPostHooks(opts.postHooks, opts.configPath, result, userOutput)
+	if len(errs) == 0 {
+		return nil
+	}
+	for _, err := range errs {
+		log.Error(err.Error())
+		result.HookErrors = append(result.HookErrors, err.Error())
+	}
+	if !opts.strictHooks {
+		return nil
+	}
+	opts.rollBackSecretsFile()
+	if err := rollBackConfigFile(opts.configPath, opts.backupPath,
+		opts.configCreated); err != nil {
+		log.Errorf("Unable to roll back the configuration file: %s",
+			err.Error())
+	} else {
+		result.Written = false
+	}
+	return result.fail(setupStagePostHook, errs[0])
+}
+
+// runPostHooks runs the --post-hook commands with the shell, in order. The
+// hooks get the path of the configuration file, and the setup summary as
+// JSON, in the environment. Every hook is run even if an earlier one fails;
+// the errors are returned.
+func runPostHooks(hooks []string, configPath string, result *setupResult,
+	stdout io.Writer) []error {
+	summary, err := marshalSetupResult(result)
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	for _, hook := range hooks {
+		log.Infof("Running post-setup hook %q", hook)
+		cmd := exec.Command("/bin/sh", "-c", hook)
+		cmd.Env = append(os.Environ(),
+			hookEnvConfigPath+"="+configPath,
+			hookEnvSummary+"="+string(summary))
+		cmd.Stdout = stdout
+		cmd.Stderr = os.Stderr
+		if err = cmd.Run(); err != nil {
+			errs = append(errs, errors.Errorf(errMsgPostHookF,
+				hook, err.Error()))
+		}
+	}
+	return errs
+}
+
+// rollBackConfigFile undoes the write of the configuration file, for
+// --strict-hooks: the backup is restored, or the file removed if setup created
+// it. An existing file without a backup is left alone.
+func rollBackConfigFile(configPath, backupPath string, created bool) error {
+	if backupPath != "" {
+		return restoreConfigBackup(backupPath, configPath)
+	}
+	if !created {
+		return errors.Errorf("No backup of the configuration file %q "+
+			"to restore", configPath)
+	}
+	if err := os.Remove(configPath); err != nil {
+		return errors.Wrapf(err, "Error removing configuration file %q",
+			configPath)
+	}
+	return nil
+}
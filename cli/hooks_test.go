@@ -0,0 +1,44 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollBackConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "mender.conf")
+	backupPath := configPath + ".bak"
+
+	// The backup is restored.
+	assert.NoError(t, ioutil.WriteFile(configPath, []byte("new"), 0600))
+	assert.NoError(t, ioutil.WriteFile(backupPath, []byte("old"), 0600))
+	assert.NoError(t, rollBackConfigFile(configPath, backupPath, false))
+	data, err := ioutil.ReadFile(configPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(data))
+
+	// An existing file without a backup is kept.
+	assert.Error(t, rollBackConfigFile(configPath, "", false))
+	assert.FileExists(t, configPath)
+
+	// A file created by setup is removed.
+	assert.NoError(t, rollBackConfigFile(configPath, "", true))
+	assert.NoFileExists(t, configPath)
+}
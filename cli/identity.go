@@ -0,0 +1,177 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	identitySourceMAC  = "mac"
+	identitySourceUUID = "uuid"
+
+	uuidRegularExpression = "^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-" +
+		"[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$"
+
+	// Uses the MAC address of the ethernet interface with the lowest index,
+	// the same way as the identity script shipped with the client.
+	identityScriptMAC = `#!/bin/sh
+# Generated by mender-setup.
+set -ue
+
+SCN=/sys/class/net
+min=65535
+arphrd_ether=1
+ifdev=
+
+for dev in $SCN/*; do
+    if [ ! -f "$dev/type" ]; then
+        continue
+    fi
+    iftype=$(cat $dev/type)
+    if [ $iftype -ne $arphrd_ether ]; then
+        continue
+    fi
+    # Skip dummy interfaces
+    if echo "$dev" | grep -q "$SCN/dummy" 2>/dev/null; then
+        continue
+    fi
+    idx=$(cat $dev/ifindex)
+    if [ $idx -lt $min ]; then
+        min=$idx
+        ifdev=$dev
+    fi
+done
+
+if [ -z "$ifdev" ]; then
+    echo "No suitable network interfaces found" >&2
+    exit 1
+fi
+echo "mac=$(cat $ifdev/address)"
+`
+	identityScriptUUIDF = `#!/bin/sh
+# Generated by mender-setup.
+echo "uuid=%s"
+`
+)
+
+// validateIdentitySource checks the --identity-source flag, which is either
+// "mac", "uuid" or the path to an existing identity script.
+func validateIdentitySource(source, uuid string) error {
+	switch source {
+	case "":
+		if uuid != "" {
+			return errors.New("--identity-uuid requires --identity-source uuid")
+		}
+		return nil
+	case identitySourceUUID:
+		if uuid == "" {
+			return nil
+		}
+		validUUIDRegex, err := regexp.Compile(uuidRegularExpression)
+		if err != nil {
+			return errors.Wrap(err, "Unable to compile regex")
+		}
+		if !validUUIDRegex.MatchString(uuid) {
+			return errors.Errorf("Invalid UUID %q", uuid)
+		}
+		return nil
+	case identitySourceMAC:
+	default:
+		info, err := os.Stat(source)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid identity source %q: expected %q, "+
+				"%q or the path to an identity script",
+				source, identitySourceMAC, identitySourceUUID)
+		}
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			return errors.Errorf("The identity script %q is not executable", source)
+		}
+	}
+	if uuid != "" {
+		return errors.New("--identity-uuid requires --identity-source uuid")
+	}
+	return nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", errors.Wrap(err, "Unable to generate a UUID")
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// installIdentityScript sets up the identity script the client runs at
+// helper. A script path is linked to, while for "mac" and "uuid" a script is
+// generated. A generated UUID is written into the script, so the identity of
+// the device stays the same.
+func installIdentityScript(source, uuid, helper string) error {
+	if err := os.MkdirAll(path.Dir(helper), 0755); err != nil {
+		return errors.Wrapf(err, "Cannot create directory %q", path.Dir(helper))
+	}
+
+	var script string
+	switch source {
+	case identitySourceMAC:
+		script = identityScriptMAC
+	case identitySourceUUID:
+		if uuid == "" {
+			var err error
+			if uuid, err = newUUID(); err != nil {
+				return err
+			}
+		}
+		script = fmt.Sprintf(identityScriptUUIDF, uuid)
+	default:
+		target, err := filepath.Abs(source)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid identity script %q", source)
+		}
+		if helperPath, _ := filepath.Abs(helper); helperPath == target {
+			// Already in place.
+			return nil
+		}
+		if err = os.Remove(helper); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Error removing identity script %q", helper)
+		}
+		if err = os.Symlink(target, helper); err != nil {
+			return errors.Wrapf(err, "Error linking identity script %q", helper)
+		}
+		log.Infof("Linked identity script %q to %q", helper, target)
+		return nil
+	}
+
+	if err := os.Remove(helper); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Error removing identity script %q", helper)
+	}
+	if err := ioutil.WriteFile(helper, []byte(script), 0755); err != nil {
+		return errors.Wrapf(err, "Error writing identity script %q", helper)
+	}
+	log.Infof("Wrote identity script %q", helper)
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender/conf"
+)
+
+const (
+	// The client runs every executable named mender-inventory-* in the
+	// inventory directory, and reports the key=value lines they print.
+	inventoryScriptName = "mender-inventory-setup"
+
+	maxInventoryKeyLength   = 64
+	maxInventoryValueLength = 1024
+
+	inventoryScriptHeader = "#!/bin/sh\n# Generated by mender-setup.\n"
+)
+
+// inventoryScriptPath is where the client looks for the inventory scripts.
+var inventoryScriptPath = path.Join(conf.GetDataDirPath(), "inventory",
+	inventoryScriptName)
+
+// parseInventoryAttributes checks the KEY=VALUE arguments of --inventory, and
+// returns them with the spaces around the keys and values removed. A key may
+// be given several times, which the server shows as a list of values.
+func parseInventoryAttributes(args []string) ([]string, error) {
+	attributes := make([]string, 0, len(args))
+	for _, arg := range args {
+		i := strings.Index(arg, "=")
+		if i < 0 {
+			return nil, errors.Errorf("Invalid inventory attribute %q, "+
+				"expected KEY=VALUE", arg)
+		}
+		key := strings.TrimSpace(arg[:i])
+		value := strings.TrimSpace(arg[i+1:])
+		switch {
+		case key == "" || value == "":
+			return nil, errors.Errorf("Invalid inventory attribute %q: "+
+				"the key and the value must not be empty", arg)
+		case len(key) > maxInventoryKeyLength:
+			return nil, errors.Errorf("The inventory key %q is longer "+
+				"than %d characters", key, maxInventoryKeyLength)
+		case len(value) > maxInventoryValueLength:
+			return nil, errors.Errorf("The value of the inventory key %q "+
+				"is longer than %d characters", key, maxInventoryValueLength)
+		case strings.ContainsAny(arg, "\n\r"):
+			return nil, errors.Errorf("The inventory attribute %q must "+
+				"not contain line breaks", key)
+		case key == "device_type":
+			return nil, errors.New("The device type is not an inventory " +
+				"attribute, give it with --device-type")
+		}
+		attributes = append(attributes, key+"="+value)
+	}
+	return attributes, nil
+}
+
+// installInventoryScript writes an inventory script printing the attributes
+// to script, replacing the one written by an earlier setup.
+func installInventoryScript(attributes []string, script string) error {
+	if err := os.MkdirAll(path.Dir(script), 0755); err != nil {
+		return errors.Wrapf(err, "Cannot create directory %q", path.Dir(script))
+	}
+	var b strings.Builder
+	b.WriteString(inventoryScriptHeader)
+	for _, attribute := range attributes {
+		// Single quoted, so that the shell leaves the text alone.
+		b.WriteString("echo '" +
+			strings.ReplaceAll(attribute, "'", `'\''`) + "'\n")
+	}
+	if err := ioutil.WriteFile(script, []byte(b.String()), 0755); err != nil {
+		return errors.Wrapf(err, "Error writing inventory script %q", script)
+	}
+	if err := os.Chmod(script, 0755); err != nil {
+		return errors.Wrapf(err, "Error writing inventory script %q", script)
+	}
+	log.Infof("Wrote inventory script %q", script)
+	return nil
+}
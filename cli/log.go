@@ -0,0 +1,90 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Secrets shorter than this are not masked, as every occurrence of them in the
+// log messages would be, which garbles the logs without hiding anything.
+const minRedactedSecretLength = 6
+
+var (
+	// Matches JSON Web Tokens, such as the tenant token and the device
+	// authorization token, wherever they show up in a log message.
+	jwtRegex = regexp.MustCompile(
+		`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+
+	logRedactor = &redactingFormatter{}
+)
+
+// redactingFormatter masks secrets in all log entries before handing them over
+// to the wrapped formatter. This covers the log messages of the client
+// libraries as well, e.g. the debug dump of the loaded configuration.
+type redactingFormatter struct {
+	log.Formatter
+
+	mutex   sync.RWMutex
+	secrets []string
+}
+
+// installLogRedactor makes the standard logger mask all secrets.
+func installLogRedactor() {
+	if log.StandardLogger().Formatter == logRedactor {
+		return
+	}
+	logRedactor.Formatter = log.StandardLogger().Formatter
+	log.SetFormatter(logRedactor)
+}
+
+// addSecret registers a secret which must never be printed in the logs.
+func (f *redactingFormatter) addSecret(secret string) {
+	if len(secret) < minRedactedSecretLength {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.secrets = append(f.secrets, secret)
+}
+
+func (f *redactingFormatter) redact(msg string) string {
+	f.mutex.RLock()
+	for _, secret := range f.secrets {
+		msg = strings.ReplaceAll(msg, secret, maskSecret(secret))
+	}
+	f.mutex.RUnlock()
+	return jwtRegex.ReplaceAllStringFunc(msg, maskSecret)
+}
+
+func (f *redactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	redacted := *entry
+	redacted.Message = f.redact(entry.Message)
+	redacted.Data = make(log.Fields, len(entry.Data))
+	for key, val := range entry.Data {
+		if _, isErr := val.(error); isErr {
+			val = fmt.Sprint(val)
+		}
+		if s, ok := val.(string); ok {
+			val = f.redact(s)
+		}
+		redacted.Data[key] = val
+	}
+	return f.Formatter.Format(&redacted)
+}
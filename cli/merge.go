@@ -0,0 +1,225 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/mendersoftware/mender/conf"
+)
+
+// deprecatedConfigKeys maps the top level keys which the client no longer
+// reads to the keys replacing them, or to "" if they are not replaced at all.
+var deprecatedConfigKeys = map[string]string{
+	"ClientProtocol":      "",
+	"PollIntervalSeconds": "UpdatePollIntervalSeconds",
+}
+
+// migrateDeprecatedKeys renames the deprecated keys in the mapping node to
+// their replacements, and removes the ones without a replacement. A deprecated
+// key is dropped if its replacement is already set. It returns the migrations
+// made, as "old -> new", in the order of the file.
+func migrateDeprecatedKeys(mapping *yaml.Node) []string {
+	var migrated []string
+	for i := 0; i+1 < len(mapping.Content); {
+		key := mapping.Content[i]
+		newKey, deprecated := deprecatedConfigKeys[key.Value]
+		if !deprecated {
+			i += 2
+			continue
+		}
+		if newKey != "" && mappingValue(mapping, newKey) == nil {
+			migrated = append(migrated, key.Value+" -> "+newKey)
+			key.Value = newKey
+			i += 2
+			continue
+		}
+		migrated = append(migrated, key.Value+" -> (removed)")
+		mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+	}
+	return migrated
+}
+
+// mergeConfigData returns the existing configuration file with the given top
+// level keys of config written into it. All the other keys, including the ones
+// the client does not know about, are kept as they are. Keys which are not set
+// in config are removed, and deprecated keys are migrated, which is returned as
+// well. Without an existing file the whole configuration is returned.
+func mergeConfigData(config *conf.MenderConfigFromFile, fields []string,
+	filename, format string) ([]byte, []string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		data, err = marshalConfig(config, format)
+		return data, nil, err
+	} else if err != nil {
+		return nil, nil, errors.Wrap(err, "Error reading configuration file")
+	}
+
+	if format == configFormatTOML {
+		// Merged as JSON, which keeps the keys but not the comments of
+		// the existing file.
+		if data, err = tomlToJSON(data); err != nil {
+			return nil, nil, errors.Wrapf(err,
+				"Error parsing configuration file %q", filename)
+		}
+	}
+	// The node tree keeps the order, and for YAML also the comments, of
+	// the existing file. JSON is valid YAML, so this parses both formats.
+	var doc yaml.Node
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, errors.Wrapf(err, "Error parsing configuration file %q",
+			filename)
+	}
+	if len(doc.Content) == 0 {
+		// Empty file
+		data, err = marshalConfig(config, format)
+		return data, nil, err
+	}
+	existing := doc.Content[0]
+	if existing.Kind != yaml.MappingNode {
+		return nil, nil, errors.Errorf("Unable to merge into configuration "+
+			"file %q: not a mapping", filename)
+	}
+	migrated := migrateDeprecatedKeys(existing)
+
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error encoding configuration to JSON")
+	}
+	var newDoc yaml.Node
+	if err = yaml.Unmarshal(configJSON, &newDoc); err != nil {
+		return nil, nil, errors.Wrap(err, "Error encoding configuration")
+	}
+	for _, field := range fields {
+		value := mappingValue(newDoc.Content[0], field)
+		if value != nil && format == configFormatYAML {
+			resetYAMLStyle(value)
+		}
+		setMappingValue(existing, field, value)
+	}
+
+	if data, err = encodeMergedConfig(&doc, format); err != nil {
+		return nil, nil, err
+	}
+	return data, migrated, nil
+}
+
+// encodeMergedConfig encodes the merged document in the given format.
+func encodeMergedConfig(doc *yaml.Node, format string) ([]byte, error) {
+	switch format {
+	case configFormatJSON, configFormatTOML:
+		var buf bytes.Buffer
+		if err := encodeJSONNode(&buf, doc.Content[0]); err != nil {
+			return nil, err
+		}
+		if format == configFormatTOML {
+			data, err := jsonToTOML(buf.Bytes())
+			return data, errors.Wrap(err, "Error encoding configuration to TOML")
+		}
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, buf.Bytes(), "", "    "); err != nil {
+			return nil, errors.Wrap(err, "Error encoding configuration to JSON")
+		}
+		return indented.Bytes(), nil
+	case configFormatYAML:
+		data, err := yaml.Marshal(doc)
+		return data, errors.Wrap(err, "Error encoding configuration to YAML")
+	}
+	return nil, validateConfigFormat(format)
+}
+
+// mappingValue returns the value of key in the mapping node, or nil.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMappingValue replaces the value of key in the mapping node, appending it
+// if the key is missing. A nil value removes the key.
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value != key {
+			continue
+		}
+		if value == nil {
+			mapping.Content = append(mapping.Content[:i],
+				mapping.Content[i+2:]...)
+		} else {
+			mapping.Content[i+1] = value
+		}
+		return
+	}
+	if value != nil {
+		mapping.Content = append(mapping.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+			value)
+	}
+}
+
+// encodeJSONNode encodes the node tree as JSON, keeping the order of the keys.
+func encodeJSONNode(buf *bytes.Buffer, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, err := json.Marshal(node.Content[i].Value)
+			if err != nil {
+				return errors.Wrap(err, "Error encoding configuration to JSON")
+			}
+			buf.Write(key)
+			buf.WriteByte(':')
+			if err = encodeJSONNode(buf, node.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, child := range node.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeJSONNode(buf, child); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case yaml.AliasNode:
+		return encodeJSONNode(buf, node.Alias)
+	default:
+		var value interface{}
+		if err := node.Decode(&value); err != nil {
+			return errors.Wrap(err, "Error decoding configuration value")
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return errors.Wrap(err, "Error encoding configuration to JSON")
+		}
+		buf.Write(data)
+	}
+	return nil
+}
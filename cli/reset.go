@@ -0,0 +1,166 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+
+	"github.com/mendersoftware/mender/conf"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+)
+
+const (
+	resetDescription = "Removes the authentication state of the device, " +
+		"and then runs setup like the setup command. This is meant for " +
+		"moving a device to another server or tenant. The device key is " +
+		"removed, so that the client generates a new one, unless " +
+		"--keep-identity is given. With --clear-update-state the state " +
+		"of an interrupted update is removed as well. Only files in the " +
+		"data directory are touched; stop the client before running this."
+
+	rspResetRemoveF     = "Removing %s\n"
+	rspResetDryRunF     = "Would remove %s\n"
+	promptResetConfirm  = "Remove the authentication state of the device? [y/N] "
+	errMsgResetAborted  = "Reset aborted"
+	errMsgResetNoPrompt = "Reset aborted: give --yes to confirm without a prompt"
+)
+
+// authStateKeys are the keys of the client database holding authentication
+// state. Current clients do not store the token, but older ones did.
+var authStateKeys = []string{
+	datastore.AuthTokenName,
+	datastore.AuthTokenCacheInvalidatorName,
+}
+
+// updateStateKeys are the keys of the client database holding the state of an
+// update in progress.
+var updateStateKeys = []string{
+	datastore.StateDataKey,
+	datastore.StateDataKeyUncommitted,
+	datastore.StandaloneStateKey,
+	datastore.UpdateControlMaps,
+}
+
+// deviceKeyFile returns the file holding the device key if it is in the data
+// directory, or an empty string. Keys elsewhere, or in an HSM, are not owned
+// by the client, and are left alone.
+func deviceKeyFile(config *conf.MenderConfig, dataStore string) string {
+	keyFile := config.Security.AuthPrivateKey
+	if keyFile == "" {
+		return path.Join(dataStore, conf.DefaultKeyFile)
+	}
+	if strings.HasPrefix(keyFile, "pkcs11:") {
+		log.Warnf("Not removing the device key %q held by the HSM", keyFile)
+		return ""
+	}
+	if rel, err := filepath.Rel(dataStore, keyFile); err != nil ||
+		strings.HasPrefix(rel, "..") {
+		log.Warnf("Not removing the device key %q outside of the data "+
+			"directory %q", keyFile, dataStore)
+		return ""
+	}
+	return keyFile
+}
+
+// confirmReset asks the user to confirm removing the authentication state.
+func (opts *setupOptionsType) confirmReset() error {
+	stdin := opts.stdinPrompter()
+	if stdin.nonInteractive() {
+		return errors.New(errMsgResetNoPrompt)
+	}
+	confirmed, err := stdin.promptYN(promptResetConfirm, false)
+	if err != nil {
+		return err
+	} else if !confirmed {
+		return errors.New(errMsgResetAborted)
+	}
+	return nil
+}
+
+// clearClientDatabase removes the given keys from the client database in the
+// data directory, if there is one.
+func clearClientDatabase(dataStore string, dbKeys []string) error {
+	dbFile := path.Join(dataStore, store.DBStoreName)
+	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+		// No client database yet, so nothing to clear in it.
+		return nil
+	}
+	dbStore := store.NewDBStore(dataStore)
+	if dbStore == nil {
+		return errors.Errorf("Unable to open the client database %q", dbFile)
+	}
+	defer dbStore.Close()
+	for _, key := range dbKeys {
+		if err := dbStore.Remove(key); err != nil {
+			return errors.Wrapf(err, "Error removing %q from the client "+
+				"database", key)
+		}
+	}
+	return nil
+}
+
+// resetDeviceState removes the authentication state of the device, after
+// asking the user, for the reset command.
+func (runOptions *runOptionsType) resetDeviceState(ctx *cli.Context,
+	config *conf.MenderConfig) error {
+	opts := &runOptions.setupOptions
+	var keyFile string
+	if !ctx.Bool("keep-identity") {
+		keyFile = deviceKeyFile(config, runOptions.dataStore)
+	}
+	dbKeys := append([]string{}, authStateKeys...)
+	if ctx.Bool("clear-update-state") {
+		dbKeys = append(dbKeys, updateStateKeys...)
+	}
+	dbFile := path.Join(runOptions.dataStore, store.DBStoreName)
+
+	rspF := rspResetRemoveF
+	if opts.dryRun {
+		rspF = rspResetDryRunF
+	}
+	if !ctx.Bool("quiet") {
+		if keyFile != "" {
+			fmt.Fprintf(userOutput, rspF, "the device key "+keyFile)
+		}
+		fmt.Fprintf(userOutput, rspF, fmt.Sprintf("%s from the client database %s",
+			strings.Join(dbKeys, ", "), dbFile))
+	}
+	if opts.dryRun {
+		return nil
+	}
+
+	if !ctx.Bool("yes") {
+		if err := opts.confirmReset(); err != nil {
+			return err
+		}
+	}
+
+	if keyFile != "" {
+		if err := os.Remove(keyFile); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Error removing the device key %q",
+				keyFile)
+		}
+	}
+	return clearClientDatabase(runOptions.dataStore, dbKeys)
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender/conf"
+)
+
+// rootfsDevicePath returns the path of the device file of a root file system
+// partition. Partitions not given as a path, like the UBI volume "ubi0_0",
+// are looked up in /dev.
+func rootfsDevicePath(part string) string {
+	if filepath.IsAbs(part) {
+		return part
+	}
+	return filepath.Join("/dev", part)
+}
+
+// validateRootfsParts checks the partitions of --rootfs-part-a and
+// --rootfs-part-b: both or none must be given, they must differ, and unless
+// checkFiles is false, their device files must exist.
+func validateRootfsParts(partA, partB string, checkFiles bool) error {
+	if partA == "" && partB == "" {
+		return nil
+	}
+	if partA == "" || partB == "" {
+		return errors.New("Both --rootfs-part-a and --rootfs-part-b " +
+			"must be given")
+	}
+	if rootfsDevicePath(partA) == rootfsDevicePath(partB) {
+		return errors.Errorf("The root file system partitions A and B "+
+			"are the same: %q", partA)
+	}
+	if !checkFiles {
+		return nil
+	}
+	for _, part := range []string{partA, partB} {
+		info, err := os.Stat(rootfsDevicePath(part))
+		if err != nil {
+			return errors.Wrapf(err, "Invalid root file system partition %q",
+				part)
+		}
+		if info.Mode()&os.ModeDevice == 0 {
+			log.Warnf("The root file system partition %q is not a "+
+				"device file", part)
+		}
+	}
+	return nil
+}
+
+// applyDualRootfs writes the partitions and boot commands given as flags to
+// the configuration, keeping the existing values of the ones not given.
+func (opts *setupOptionsType) applyDualRootfs(config *conf.MenderConfigFromFile) {
+	if opts.rootfsPartA != "" {
+		config.RootfsPartA = opts.rootfsPartA
+		config.RootfsPartB = opts.rootfsPartB
+	}
+	if opts.bootSetActive != "" {
+		config.BootUtilitiesSetActivePart = opts.bootSetActive
+	}
+	if opts.bootGetNextActive != "" {
+		config.BootUtilitiesGetNextActivePart = opts.bootGetNextActive
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/conf"
+)
+
+// The secrets file is always private, whatever --config-mode says.
+const secretsFileMode = 0600
+
+// configSecrets holds the settings written to the secrets file. It is read by
+// the client as its fallback configuration, which the main configuration file
+// is merged over, key by key.
+type configSecrets struct {
+	HttpsClient *client.HttpsClient `json:",omitempty"`
+	TenantToken string              `json:",omitempty"`
+}
+
+// splitConfigSecrets returns a copy of config without the tenant token and the
+// client key, and the secrets taken out of it.
+func splitConfigSecrets(
+	config *conf.MenderConfigFromFile) (*conf.MenderConfigFromFile, *configSecrets) {
+	mainConfig := *config
+	secrets := &configSecrets{TenantToken: config.TenantToken}
+	if config.HttpsClient.Key != "" {
+		secrets.HttpsClient = &client.HttpsClient{Key: config.HttpsClient.Key}
+	}
+	mainConfig.TenantToken = ""
+	mainConfig.HttpsClient.Key = ""
+	return &mainConfig, secrets
+}
+
+// validateSecretsPath checks that the secrets file given by --secrets-path can
+// be used along with the configuration file.
+func validateSecretsPath(secretsPath, configPath string) error {
+	if secretsPath == "" {
+		return nil
+	}
+	if filepath.Clean(secretsPath) == filepath.Clean(configPath) {
+		return errors.Errorf("The secrets file %q must not be the "+
+			"configuration file", secretsPath)
+	}
+	if filepath.Clean(secretsPath) != conf.DefaultFallbackConfFile {
+		log.Warnf("The client reads the secrets file %q only if started "+
+			"with --fallback-config %s", secretsPath, secretsPath)
+	}
+	return nil
+}
+
+// saveSecretsFile writes the secrets file, after backing it up like the
+// configuration file.
+func (opts *setupOptionsType) saveSecretsFile(data []byte) error {
+	unchanged, err := configFileUnchanged(opts.secretsPath, data,
+		configFormatJSON)
+	if err != nil {
+		return err
+	}
+	if unchanged {
+		return ensureConfigFileMode(opts.secretsPath, secretsFileMode)
+	}
+	if _, err = os.Stat(opts.secretsPath); os.IsNotExist(err) {
+		opts.secretsCreated = true
+	}
+	if !opts.noBackup {
+		opts.secretsBackupPath, err = backupConfigFile(opts.secretsPath,
+			opts.maxBackups)
+		if err != nil {
+			return err
+		}
+	}
+	if err = writeConfigData(data, opts.secretsPath,
+		secretsFileMode); err != nil {
+		return err
+	}
+	opts.secretsWritten = true
+	return nil
+}
+
+// rollBackSecretsFile undoes the write of the secrets file, along with the
+// configuration file.
+func (opts *setupOptionsType) rollBackSecretsFile() {
+	if !opts.secretsWritten {
+		return
+	}
+	if err := rollBackConfigFile(opts.secretsPath, opts.secretsBackupPath,
+		opts.secretsCreated); err != nil {
+		log.Errorf("Unable to roll back the secrets file: %s", err.Error())
+		return
+	}
+	opts.secretsWritten = false
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveSecretsFileRollBack(t *testing.T) {
+	secretsPath := filepath.Join(t.TempDir(), "mender-secrets.conf")
+	assert.NoError(t, ioutil.WriteFile(secretsPath, []byte(`{"TenantToken":"old"}`),
+		0600))
+	opts := &setupOptionsType{secretsPath: secretsPath, maxBackups: 1}
+
+	_, secrets := splitConfigSecrets(testConfig())
+	data, err := marshalConfigValue(secrets, configFormatJSON)
+	assert.NoError(t, err)
+	assert.NoError(t, opts.saveSecretsFile(data))
+	assert.True(t, opts.secretsWritten)
+	assert.NotEmpty(t, opts.secretsBackupPath)
+	written, err := ioutil.ReadFile(secretsPath)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(data), string(written))
+
+	opts.rollBackSecretsFile()
+	assert.False(t, opts.secretsWritten)
+	restored, err := ioutil.ReadFile(secretsPath)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"TenantToken":"old"}`, string(restored))
+}
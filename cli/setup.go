@@ -21,11 +21,13 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -35,26 +37,82 @@ import (
 
 	"github.com/mendersoftware/mender/client"
 	"github.com/mendersoftware/mender/conf"
-	"github.com/mendersoftware/mender/device"
 	"github.com/mendersoftware/mender/system"
 )
 
 type setupOptionsType struct {
 	configPath         string
+	configFormat       string
 	deviceType         string
 	username           string
 	password           string
 	serverURL          string
 	serverIP           string
 	serverCert         string
+	serverCertPEM      []byte // pasted certificate, saved to serverCert
+	clientCert         string
+	clientKey          string
+	sslEngine          string
+	disableKeepAlive   bool
+	idleConnTimeout    int
+	preferIPv4         bool
+	serverRetryAfter   time.Duration // set by the connectivity check
+	checkClock         bool
+	maxClockSkew       time.Duration
 	tenantToken        string
 	invPollInterval    int
 	retryPollInterval  int
 	updatePollInterval int
+	minPollInterval    int
 	hostedMender       bool
-	demo               bool // deprecated
+	demo               bool // the one-shot --demo profile
 	demoServer         bool
 	demoIntervals      bool
+	noPrompt           bool
+	skipConnectivity   bool
+	httpProxy          string
+	httpsProxy         string
+	noProxy            string
+	dryRun             bool
+	noBackup           bool
+	maxBackups         int
+	backupPath         string // set when the configuration is saved
+	configWritten      bool   // set when the configuration is saved
+	configCreated      bool   // set when the saved configuration is new
+	systemdUnit        bool
+	systemdDir         string
+	menderBinary       string
+	jsonSummary        bool
+	detailedExitCodes  bool
+	merge              bool
+	timeout            time.Duration
+	waitReachable      time.Duration
+	waitOptional       bool
+	connectTimeout     time.Duration
+	traceHTTP          bool
+	userAgent          string
+	offline            bool
+	apiPathPrefix      string
+	verifyAuth         bool
+	artifactVerifyKeys []string
+	requireSigned      bool // warn if unsigned artifacts are accepted
+	rootfsPartA        string
+	rootfsPartB        string
+	bootSetActive      string
+	bootGetNextActive  string
+	migratedKeys       []string
+	configMode         string
+	secretsPath        string
+	secretsBackupPath  string      // set when the secrets file is saved
+	secretsWritten     bool        // set when the secrets file is saved
+	secretsCreated     bool        // set when the saved secrets file is new
+	configFileMode     os.FileMode // parsed from configMode
+	prompter           prompter    // the terminal if not set
+	identitySource     string
+	identityUUID       string
+	postHooks          []string
+	inventory          []string // KEY=VALUE attributes of --inventory
+	strictHooks        bool
 }
 
 // ------------------------------ Setup constants ------------------------------
@@ -65,8 +123,10 @@ const ( // state enum
 	stateServerURL
 	stateServerIP
 	stateServerCert
+	stateClientCert
 	stateCredentials
 	statePolling
+	stateProxy
 	stateDone
 	stateInvalid = -1
 )
@@ -77,6 +137,8 @@ var (
 	DefaultLocalTrustMenderDir    = "/usr/local/share/ca-certificates/mender"
 	DefaultLocalTrustMenderPrefix = "mender-demo-"
 	DefaultLocalTrustMenderFormat = "mender-demo-%d.crt"
+	DefaultProxyConfFile          = "/etc/systemd/system/mender-client.service.d/proxy.conf"
+	DefaultServerCertFile         = path.Join(conf.GetConfDirPath(), "server.crt")
 )
 
 func getMenderDemoCertPath() string {
@@ -101,6 +163,11 @@ const (
 		`(?:[\x01-\x08\x0b\x0c\x0e-\x1f\x21-\x5a\x53-\x7f]|` +
 		`\\[\x01-\x09\x0b\x0c\x0e-\x7f])+)\])`
 
+	// Intervals below these are allowed, but put load on the server
+	recommendedUpdatePoll    = 300
+	recommendedInventoryPoll = 3600
+	recommendedRetryPoll     = 30
+
 	// Default constants
 	defaultServerIP              = "127.0.0.1"
 	defaultServerURL             = "https://docker.mender.io"
@@ -122,12 +189,16 @@ const (
 		"its inventory data.\nGet started by first configuring the " +
 		"device type and settings for communicating with the server."
 	promptDone       = "Mender setup successfully."
+	promptNoChanges  = "Mender setup successfully, no changes."
 	promptDeviceType = "\nThe device type property is used to determine " +
 		"which Mender Artifact are compatible with this device.\n" +
 		"Enter a name for the device type (e.g. " +
 		"raspberrypi3): [%s] "
 	promptHostedMender = "\nAre you connecting this device to " +
 		"hosted.mender.io? [Y/n] "
+	promptTenantToken = "\nPaste the tenant token of your organization " +
+		"(the input is hidden), or leave blank to log in to " +
+		"hosted.mender.io: "
 	promptCredentials = "Enter your credentials for hosted.mender.io"
 	promptDemoServer  = "\nDemo server uses a self-signed certifcate " +
 		"for \"docker.mender.io\" and modifies device's /etc/hosts with " +
@@ -135,12 +206,20 @@ const (
 		"Do you want to configure the client for a demo server? [Y/n] "
 	promptServerIP = "\nSet the IP of the Mender Server: [" +
 		defaultServerIP + "] "
-	promptServerURL = "\nSet the URL of the Mender Server: [" +
+	promptServerURL = "\nSet the URL of the Mender Server, or a comma " +
+		"separated list of URLs to fall over to: [" +
 		defaultServerURL + "] "
 	promptServerCert = "\nSet the location of the certificate of the " +
 		"server; leave blank if using http (not recommended) or a " +
 		"certificate from a known authority " +
-		"(filepath, for example /etc/mender/server.crt): "
+		"(filepath, for example /etc/mender/server.crt, or paste the PEM " +
+		"certificate followed by an empty line): "
+	promptClientCert = "\nDo you want to authenticate the device with a " +
+		"client certificate (mutual TLS)? [y/N] "
+	promptClientCertFile = "Set the location of the client certificate " +
+		"(filepath): "
+	promptClientKeyFile = "Set the location of the private key of the " +
+		"client certificate (filepath): "
 	promptDemoIntervals = "\nDemo intervals uses short poll and retry " +
 		"intervals (Recommended for testing.)\n" +
 		"Do you want to run the client in demo mode? [Y/n] "
@@ -155,6 +234,12 @@ const (
 	promptInventoryPoll = "Set the inventory poll interval - the " +
 		"frequency with which the client will send inventory data to " +
 		"the server, in seconds: [28800]" // (defaultInventoryPoll)
+	promptProxy = "\nDo you want to configure an HTTP(S) proxy for " +
+		"connecting to the server? [%s] "
+	promptHTTPProxy  = "Set the HTTP proxy URL, leave blank for none: [%s] "
+	promptHTTPSProxy = "Set the HTTPS proxy URL, leave blank for none: [%s] "
+	promptNoProxy    = "Set the comma separated list of hosts which " +
+		"should not use the proxy: [%s] "
 	// Response on invalid input
 	rspInvalidDevice = "The device type \"%s\" contains spaces or special " +
 		"characters.\nPlease try again: [%s]"
@@ -168,39 +253,116 @@ const (
 		"connection and try again."
 	rspNotSeconds = "The value you entered wasn’t an integer number.\n" +
 		"Please enter a number (in seconds): "
-	rspInvalidInterval = "Polling interval too short.\nPlease enter a " +
-		"value of minimum 5 seconds: " // (minimumPollInterval)
+	rspInvalidIntervalF = "Polling interval too short.\nPlease enter a " +
+		"value of minimum %d seconds: "
 	rspInvalidURL = "Please enter a valid url for the server: "
 	rspInvalidIP  = "Please enter a valid IP address: "
 	// NOTE: format
-	rspFileNotExist = "The file '%s' does not exist.\nPlease try again: "
+	rspFileNotExist    = "The file '%s' does not exist.\nPlease try again: "
+	rspInvalidProxyURL = "Please enter a valid proxy URL " +
+		"(e.g. http://proxy.example.com:3128): "
+
+	// Dry run
+	rspDryRunNoChanges  = "No changes to the configuration file %q.\n"
+	rspDryRunDeviceType = "Device type %q would be written to %q.\n"
+
+	rspDemoInsecure = "\n" +
+		"****************************************************************\n" +
+		"* WARNING: This is a demo configuration. It does not verify    *\n" +
+		"* the server certificate, and must not be used in production.  *\n" +
+		"****************************************************************\n"
+
+	rspOfflineUnverified = "Offline setup: the configuration has not " +
+		"been verified against the server.\n"
+
+	errMsgMinPollIntervalF = "--min-poll-interval must be at least %d seconds"
+	errMsgOfflineLogin     = "Logging in to hosted Mender needs network " +
+		"access, give --tenant-token with --offline"
+
+	// Non-interactive mode
+	errMsgNoPromptMissingF = "Refusing to prompt for input in " +
+		"non-interactive mode, missing value for: %s"
 )
 
 // ---------------------------- END Setup constants ----------------------------
 
+// getDefaultDeviceType returns the first valid device type found in the
+// --device-type-file and the data store, falling back to the hostname.
 func getDefaultDeviceType(ctx *cli.Context) (devType string) {
-	devType, err := device.GetDeviceType(path.
-		Join(ctx.String("data"), "device_type"))
+	if ctx.Bool("offline") {
+		// The files of the host do not describe the device.
+		return "unknown"
+	}
+	candidates := localDeviceTypeCandidates([]string{
+		ctx.String("device-type-file"),
+		path.Join(ctx.String("data"), "device_type"),
+	})
+	if len(candidates) > 0 {
+		return candidates[0].deviceType
+	}
+	hostName, err := ioutil.ReadFile("/etc/hostname")
 	if err != nil {
-		hostName, err := ioutil.ReadFile("/etc/hostname")
-		if err != nil {
-			return "unknown"
-		}
-		devType = string(hostName)
-		devType = strings.Trim(devType, "\n")
+		return "unknown"
 	}
+	devType = string(hostName)
+	devType = strings.Trim(devType, "\n")
 	return devType
 }
 
+// prompter asks the user for the setup options. The interactive setup only
+// talks to the user through it, so that it can be driven by something other
+// than the terminal.
+type prompter interface {
+	// promptUser shows the prompt and returns the response, without the
+	// trailing newline.
+	promptUser(prompt string, disableEcho bool) (string, error)
+	// promptYN asks a yes/no question.
+	promptYN(prompt string, defaultYes bool) (bool, error)
+	// readPastedPEM reads PEM data pasted by the user, starting with
+	// firstLine.
+	readPastedPEM(firstLine string) ([]byte, error)
+	// nonInteractive returns true if every prompt is answered with the
+	// default value without asking the user.
+	nonInteractive() bool
+}
+
+// stdinReader is the prompter for the terminal.
 type stdinReader struct {
 	reader *bufio.Reader
+	// If set, no prompts are shown and every prompt is answered with
+	// an empty response, i.e. the default value.
+	noPrompt bool
+}
+
+func newStdinReader(noPrompt bool) *stdinReader {
+	return &stdinReader{
+		reader: bufio.NewReader(os.Stdin),
+		noPrompt: noPrompt ||
+			!terminal.IsTerminal(int(os.Stdin.Fd())),
+	}
+}
+
+// stdinPrompter returns the prompter for the setup options, which is the
+// terminal unless set.
+func (opts *setupOptionsType) stdinPrompter() prompter {
+	if opts.prompter == nil {
+		opts.prompter = newStdinReader(opts.noPrompt)
+	}
+	return opts.prompter
+}
+
+func (stdin *stdinReader) nonInteractive() bool {
+	return stdin.noPrompt
 }
 
 func (stdin *stdinReader) promptUser(prompt string, disableEcho bool) (string, error) {
 	var rsp string
 	var err error
-	fmt.Print(prompt)
-	if disableEcho {
+	if stdin.noPrompt {
+		return "", nil
+	}
+	fmt.Fprint(userOutput, prompt)
+	if disableEcho && terminal.IsTerminal(int(os.Stdin.Fd())) {
 		pwd, err := terminal.ReadPassword(int(os.Stdin.Fd()))
 		if err == nil {
 			rsp = string(pwd)
@@ -221,6 +383,10 @@ func (stdin *stdinReader) promptUser(prompt string, disableEcho bool) (string, e
 // and false for N/n
 func (stdin *stdinReader) promptYN(prompt string,
 	defaultYes bool) (bool, error) {
+	if stdin.noPrompt {
+		// Never enable anything implicitly in non-interactive mode
+		return false, nil
+	}
 	ret := defaultYes
 	rsp, err := stdin.promptUser(prompt, false)
 	if err != nil {
@@ -245,13 +411,63 @@ func (stdin *stdinReader) promptYN(prompt string,
 	return ret, nil
 }
 
+// applyDemoProfile answers every setup question for a local demo setup: the
+// demo server with short poll intervals, and the default device type. Flags
+// which are given explicitly still take precedence.
+func (opts *setupOptionsType) applyDemoProfile(ctx *cli.Context) {
+	profile := map[string]string{
+		"hosted-mender": "false",
+		"demo-server":   "true",
+		"demo-polling":  "true",
+		"server-ip":     defaultServerIP,
+		"device-type":   getDefaultDeviceType(ctx),
+		"no-prompt":     "true",
+	}
+	if ctx.IsSet("server-url") {
+		// The server is given, so there is no demo server to look up.
+		delete(profile, "server-ip")
+	}
+	for flag, value := range profile {
+		if !ctx.IsSet(flag) {
+			_ = ctx.Set(flag, value)
+		}
+	}
+}
+
 // CLI functions for handling implicitly set flags.
 func (opts *setupOptionsType) handleImplicitFlags(ctx *cli.Context) error {
-	if ctx.IsSet("demo") {
-		// deprecated, implies both --demo-server and --demo-polling
-		_ = ctx.Set("demo-server", "true")
-		_ = ctx.Set("demo-polling", "true")
+	if opts.demo {
+		if opts.hostedMender {
+			return errors.Errorf(errMsgConflictingArgumentsF,
+				"hosted-mender", "demo")
+		}
+		opts.applyDemoProfile(ctx)
+	}
+	opts.handlePollFlags(ctx)
+
+	if opts.hostedMender && opts.demoServer {
+		return errors.Errorf(errMsgConflictingArgumentsF,
+			"hosted-mender", "demo-server")
+	}
+	if opts.minPollInterval < minimumPollInterval {
+		return errors.Errorf(errMsgMinPollIntervalF, minimumPollInterval)
+	}
+	if err := opts.parseFlagValues(ctx); err != nil {
+		return err
 	}
+	if err := opts.checkConflictingFlags(ctx); err != nil {
+		return err
+	}
+	if err := validateIdentitySource(opts.identitySource,
+		opts.identityUUID); err != nil {
+		return err
+	}
+	return opts.handleServerFlags(ctx)
+}
+
+// handlePollFlags turns off the demo intervals when any poll interval is
+// given explicitly.
+func (opts *setupOptionsType) handlePollFlags(ctx *cli.Context) {
 	if ctx.IsSet("update-poll") {
 		_ = ctx.Set("demo-polling", "false")
 		opts.demoIntervals = false
@@ -267,8 +483,91 @@ func (opts *setupOptionsType) handleImplicitFlags(ctx *cli.Context) error {
 		opts.demoIntervals = false
 		opts.retryPollInterval = ctx.Int("retry-poll")
 	}
+}
+
+// parseFlagValues parses and validates the flags taking a value.
+func (opts *setupOptionsType) parseFlagValues(ctx *cli.Context) error {
+	var err error
+	if opts.configFileMode, err = parseConfigMode(opts.configMode); err != nil {
+		return err
+	}
+	if opts.apiPathPrefix, err = normalizeAPIPathPrefix(
+		opts.apiPathPrefix); err != nil {
+		return err
+	}
+	opts.artifactVerifyKeys = ctx.StringSlice("artifact-verify-key")
+	// Checked even with --offline: with a wrong key, the client rejects
+	// every update.
+	for _, keyFile := range opts.artifactVerifyKeys {
+		if err = validateArtifactVerifyKey(keyFile); err != nil {
+			return err
+		}
+	}
+	if err = validateRootfsParts(opts.rootfsPartA, opts.rootfsPartB,
+		!opts.offline); err != nil {
+		return err
+	}
+	if opts.inventory, err = parseInventoryAttributes(
+		ctx.StringSlice("inventory")); err != nil {
+		return err
+	}
+	opts.postHooks = ctx.StringSlice("post-hook")
+	return validateSecretsPath(opts.secretsPath, opts.configPath)
+}
+
+// checkConflictingFlags returns an error for flags which can not be combined,
+// and lets --offline imply --skip-connectivity-check.
+func (opts *setupOptionsType) checkConflictingFlags(ctx *cli.Context) error {
+	// Without a backup there is nothing to roll back to.
+	if opts.strictHooks && opts.noBackup {
+		return errors.Errorf(errMsgConflictingArgumentsF,
+			"strict-hooks", "no-backup")
+	}
+	if opts.connectTimeout < 0 {
+		return errors.New("--connect-timeout must not be negative")
+	}
+	if opts.waitReachable < 0 {
+		return errors.New("--wait-reachable must not be negative")
+	}
+	if opts.waitOptional && opts.waitReachable == 0 {
+		return errors.New("--wait-reachable-optional requires --wait-reachable")
+	}
+	for _, flag := range []string{"offline", "skip-connectivity-check"} {
+		if opts.waitReachable > 0 && ctx.Bool(flag) {
+			return errors.Errorf(errMsgConflictingArgumentsF,
+				flag, "wait-reachable")
+		}
+	}
+	if opts.offline && opts.verifyAuth {
+		return errors.Errorf(errMsgConflictingArgumentsF,
+			"offline", "verify-auth")
+	}
+	if opts.offline {
+		_ = ctx.Set("skip-connectivity-check", "true")
+		opts.skipConnectivity = true
+	}
+	return nil
+}
 
-	if ctx.IsSet("server-url") || ctx.IsSet("server-ip") {
+// handleServerFlags checks the server flags against each other, and sets
+// the server type implied by them.
+func (opts *setupOptionsType) handleServerFlags(ctx *cli.Context) error {
+	if opts.hostedMender {
+		// Hosted Mender has a fixed server URL.
+		if ctx.IsSet("server-url") &&
+			strings.TrimSuffix(opts.serverURL, "/") != hostedMenderURL {
+			return errors.Errorf(errMsgConflictingArgumentsF,
+				"hosted-mender", "server-url")
+		}
+		if ctx.IsSet("server-ip") {
+			return errors.Errorf(errMsgConflictingArgumentsF,
+				"hosted-mender", "server-ip")
+		}
+		if opts.apiPathPrefix != "" {
+			return errors.Errorf(errMsgConflictingArgumentsF,
+				"hosted-mender", "server-api-path-prefix")
+		}
+	} else if ctx.IsSet("server-url") || ctx.IsSet("server-ip") {
 		if ctx.IsSet("server-url") && ctx.IsSet("server-ip") {
 			return errors.Errorf(errMsgConflictingArgumentsF,
 				"server-url", "server-ip")
@@ -285,10 +584,72 @@ func (opts *setupOptionsType) handleImplicitFlags(ctx *cli.Context) error {
 	return nil
 }
 
-func (opts *setupOptionsType) askCredentials(stdin *stdinReader,
+// missingRequiredFlags returns the flags which need to be given (and be valid)
+// in order to run the setup without prompting the user for input. The flags
+// are listed in the order they would otherwise have been prompted for.
+func (opts *setupOptionsType) missingRequiredFlags(ctx *cli.Context) ([]string, error) {
+	var missing []string
+	validDeviceRegex, err := regexp.Compile(validDeviceRegularExpression)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to compile regex")
+	}
+	validURLRegex, err := regexp.Compile(validURLRegularExpression)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to compile regex")
+	}
+	validEmailRegex, err := regexp.Compile(validEmailRegularExpression)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to compile regex")
+	}
+
+	if !validDeviceRegex.Match([]byte(ctx.String("device-type"))) {
+		missing = append(missing, "--device-type")
+	}
+	if opts.hostedMender {
+		if !ctx.IsSet("tenant-token") && opts.clientCert == "" &&
+			(opts.offline || !(validEmailRegex.Match([]byte(opts.username)) &&
+				opts.password != "")) {
+			missing = append(missing, "--tenant-token")
+		}
+	} else if !opts.demoServer {
+		if !ctx.IsSet("server-url") ||
+			!validServerURLs(validURLRegex, opts.serverURL) {
+			missing = append(missing, "--server-url")
+		}
+	}
+	return append(missing, opts.invalidPollFlags(ctx)...), nil
+}
+
+// invalidPollFlags returns the poll interval flags given with a value below
+// the minimum poll interval.
+func (opts *setupOptionsType) invalidPollFlags(ctx *cli.Context) []string {
+	var invalid []string
+	if opts.demoIntervals {
+		return nil
+	}
+	for _, interval := range []struct {
+		flag  string
+		value int
+	}{
+		{"update-poll", opts.updatePollInterval},
+		{"inventory-poll", opts.invPollInterval},
+		{"retry-poll", opts.retryPollInterval},
+	} {
+		if ctx.IsSet(interval.flag) &&
+			interval.value < opts.minPollInterval {
+			invalid = append(invalid, "--"+interval.flag)
+		}
+	}
+	return invalid
+}
+
+func (opts *setupOptionsType) askCredentials(stdin prompter,
 	validEmailRegex *regexp.Regexp) error {
 	var err error
 
+	if stdin.nonInteractive() {
+		return errors.Errorf(errMsgNoPromptMissingF, "--username, --password")
+	}
 	opts.username, err = stdin.promptUser("Email: ", false)
 	if err != nil {
 		return err
@@ -312,13 +673,13 @@ func (opts *setupOptionsType) askCredentials(stdin *stdinReader,
 	// Disable stty echo when typing password
 	opts.password, err = stdin.promptUser(
 		"Password: ", true)
-	fmt.Println()
+	fmt.Fprintln(userOutput)
 	if err != nil {
 		return err
 	}
 	for {
 		if opts.password == "" {
-			fmt.Print("Password cannot be " +
+			fmt.Fprint(userOutput, "Password cannot be "+
 				"blank.\nTry again: ")
 			opts.password, err = stdin.promptUser(
 				"Password: ", true)
@@ -333,7 +694,7 @@ func (opts *setupOptionsType) askCredentials(stdin *stdinReader,
 }
 
 func (opts *setupOptionsType) askDeviceType(ctx *cli.Context,
-	stdin *stdinReader) (int, error) {
+	stdin prompter) (int, error) {
 	defaultDevType := getDefaultDeviceType(ctx)
 	devTypePrompt := fmt.Sprintf(promptDeviceType, defaultDevType)
 	validDeviceRegex, err := regexp.Compile(validDeviceRegularExpression)
@@ -366,7 +727,7 @@ func (opts *setupOptionsType) askDeviceType(ctx *cli.Context,
 }
 
 func (opts *setupOptionsType) askHostedMender(ctx *cli.Context,
-	stdin *stdinReader) (int, error) {
+	stdin prompter) (int, error) {
 	var state int
 
 	if !ctx.IsSet("hosted-mender") {
@@ -387,7 +748,7 @@ func (opts *setupOptionsType) askHostedMender(ctx *cli.Context,
 }
 
 func (opts *setupOptionsType) askDemoServer(ctx *cli.Context,
-	stdin *stdinReader) (int, error) {
+	stdin prompter) (int, error) {
 	var state int
 
 	if !ctx.IsSet("demo-server") {
@@ -399,7 +760,7 @@ func (opts *setupOptionsType) askDemoServer(ctx *cli.Context,
 	}
 	if opts.hostedMender {
 		if opts.demoIntervals {
-			state = stateDone
+			state = stateProxy
 		} else {
 			state = statePolling
 		}
@@ -414,7 +775,7 @@ func (opts *setupOptionsType) askDemoServer(ctx *cli.Context,
 }
 
 func (opts *setupOptionsType) askServerURL(ctx *cli.Context,
-	stdin *stdinReader) (int, error) {
+	stdin prompter) (int, error) {
 	validURLRegex, err := regexp.Compile(validURLRegularExpression)
 	if err != nil {
 		return stateInvalid, errors.Wrap(err, "Unable to compile regex")
@@ -432,7 +793,7 @@ func (opts *setupOptionsType) askServerURL(ctx *cli.Context,
 	for {
 		if opts.serverURL == "" {
 			opts.serverURL = defaultServerURL
-		} else if !validURLRegex.Match([]byte(opts.serverURL)) {
+		} else if !validServerURLs(validURLRegex, opts.serverURL) {
 			opts.serverURL, err = stdin.promptUser(
 				rspInvalidURL, false)
 			if err != nil {
@@ -445,8 +806,66 @@ func (opts *setupOptionsType) askServerURL(ctx *cli.Context,
 	return stateServerCert, nil
 }
 
+// serverURLs splits the server URL option, which may be a comma separated list
+// of servers the client can fall over to, in order of preference, and adds
+// the API path prefix to every URL not already ending with it. The client
+// appends the API endpoints to the server URL, so a server behind a sub-path
+// needs no further configuration.
+func (opts *setupOptionsType) serverURLs() []string {
+	var serverURLs []string
+	for _, serverURL := range strings.Split(opts.serverURL, ",") {
+		serverURL = strings.TrimSpace(serverURL)
+		if serverURL == "" {
+			continue
+		}
+		if opts.apiPathPrefix != "" {
+			serverURL = strings.TrimSuffix(serverURL, "/")
+			if !strings.HasSuffix(serverURL, opts.apiPathPrefix) {
+				serverURL += opts.apiPathPrefix
+			}
+		}
+		serverURLs = append(serverURLs, serverURL)
+	}
+	return serverURLs
+}
+
+// normalizeAPIPathPrefix returns the path prefix with a single leading slash
+// and no trailing slash, or an empty string for no prefix.
+func normalizeAPIPathPrefix(prefix string) (string, error) {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if prefix == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(prefix, "?#: \t") {
+		return "", errors.Errorf("Invalid server API path prefix %q", prefix)
+	}
+	return "/" + prefix, nil
+}
+
+func (opts *setupOptionsType) menderServers() []client.MenderServer {
+	var servers []client.MenderServer
+	for _, serverURL := range opts.serverURLs() {
+		servers = append(servers, client.MenderServer{
+			ServerURL: serverURL})
+	}
+	return servers
+}
+
+// validServerURLs returns true if serverURL is a valid URL, or a comma
+// separated list of valid URLs.
+func validServerURLs(validURLRegex *regexp.Regexp, serverURL string) bool {
+	opts := setupOptionsType{serverURL: serverURL}
+	serverURLs := opts.serverURLs()
+	for _, u := range serverURLs {
+		if !validURLRegex.MatchString(u) {
+			return false
+		}
+	}
+	return len(serverURLs) > 0
+}
+
 func (opts *setupOptionsType) askServerIP(ctx *cli.Context,
-	stdin *stdinReader) (int, error) {
+	stdin prompter) (int, error) {
 	validIPRegex, err := regexp.Compile(validIPRegularExpression)
 	if err != nil {
 		return stateInvalid, errors.Wrap(err, "Unable to compile regex")
@@ -485,10 +904,15 @@ func (opts *setupOptionsType) askServerIP(ctx *cli.Context,
 }
 
 func (opts *setupOptionsType) askServerCert(ctx *cli.Context,
-	stdin *stdinReader) (int, error) {
+	stdin prompter) (int, error) {
 	var err error
 	if ctx.IsSet("server-cert") {
-		return statePolling, nil
+		if opts.serverCert != "" && !opts.offline {
+			if err = validateCertificateFile(opts.serverCert); err != nil {
+				return stateInvalid, err
+			}
+		}
+		return stateClientCert, nil
 	}
 	opts.serverCert, err = stdin.promptUser(
 		promptServerCert, false)
@@ -496,19 +920,71 @@ func (opts *setupOptionsType) askServerCert(ctx *cli.Context,
 		return stateInvalid, err
 	}
 	for {
+		rsp := ""
 		if opts.serverCert == "" {
 			// No certificates is allowed
 			break
-		} else if _, err = os.Stat(opts.serverCert); err != nil {
-			rsp := fmt.Sprintf(rspFileNotExist, opts.serverCert)
-			opts.serverCert, err = stdin.promptUser(
-				rsp, false)
+		} else if strings.HasPrefix(opts.serverCert, pemBeginPrefix) {
+			pemData, err := stdin.readPastedPEM(opts.serverCert)
 			if err != nil {
 				return stateInvalid, err
 			}
+			if err = validateCertificatePEM(pemData); err == nil {
+				opts.serverCertPEM = pemData
+				opts.serverCert = DefaultServerCertFile
+				break
+			}
+			rsp = rspInvalidPastedCertificate
+		} else if _, err = os.Stat(opts.serverCert); err != nil {
+			rsp = fmt.Sprintf(rspFileNotExist, opts.serverCert)
+		} else if err = validateCertificateFile(opts.serverCert); err != nil {
+			rsp = fmt.Sprintf(rspInvalidCertificate, opts.serverCert)
 		} else {
 			break
 		}
+		opts.serverCert, err = stdin.promptUser(
+			rsp, false)
+		if err != nil {
+			return stateInvalid, err
+		}
+	}
+	return stateClientCert, nil
+}
+
+func (opts *setupOptionsType) askClientCert(ctx *cli.Context,
+	stdin prompter) (int, error) {
+	if ctx.IsSet("client-cert") || ctx.IsSet("client-key") {
+		if opts.offline {
+			return statePolling, nil
+		}
+		if err := validateClientCertificate(opts.clientCert,
+			opts.clientKey, opts.sslEngine); err != nil {
+			return stateInvalid, err
+		}
+		return statePolling, nil
+	}
+	useClientCert, err := stdin.promptYN(promptClientCert, false)
+	if err != nil {
+		return stateInvalid, err
+	}
+	if !useClientCert {
+		return statePolling, nil
+	}
+	for {
+		if opts.clientCert, err = stdin.promptUser(
+			promptClientCertFile, false); err != nil {
+			return stateInvalid, err
+		}
+		if opts.clientKey, err = stdin.promptUser(
+			promptClientKeyFile, false); err != nil {
+			return stateInvalid, err
+		}
+		err = validateClientCertificate(opts.clientCert,
+			opts.clientKey, opts.sslEngine)
+		if err == nil {
+			break
+		}
+		fmt.Fprintf(userOutput, rspInvalidClientCertificate, err.Error())
 	}
 	return statePolling, nil
 }
@@ -519,7 +995,9 @@ func (opts *setupOptionsType) getTenantToken(
 		Token string `json:"tenant_token"`
 	}
 
-	tokReq, err := http.NewRequest(
+	ctx, cancel := opts.networkContext()
+	defer cancel()
+	tokReq, err := http.NewRequestWithContext(ctx,
 		"GET",
 		hostedMenderURL+
 			"/api/management/v1/tenantadm/user/tenant",
@@ -531,17 +1009,17 @@ func (opts *setupOptionsType) getTenantToken(
 	tokReq.Header = map[string][]string{
 		"Authorization": {"Bearer " + string(userToken)},
 	}
-	rsp, err := client.Do(tokReq)
+	rsp, err := opts.requester(client).Do(tokReq)
 	if rsp != nil {
 		defer rsp.Body.Close()
 	}
 	if err != nil {
-		return errors.Wrap(err,
+		return errors.Wrap(opts.timeoutError(err, "Tenant token request"),
 			"Tenant token request FAILED.")
 	}
 	data, err := ioutil.ReadAll(rsp.Body)
 	if err != nil {
-		return errors.Wrap(err,
+		return errors.Wrap(opts.timeoutError(err, "Tenant token request"),
 			"Reading tenant token FAILED.")
 	}
 	tokRsp := new(tenantTokenResponse)
@@ -550,6 +1028,7 @@ func (opts *setupOptionsType) getTenantToken(
 		return errors.Wrap(err,
 			"Error parsing JSON response.")
 	}
+	logRedactor.addSecret(tokRsp.Token)
 	opts.tenantToken = tokRsp.Token
 	log.Info("Successfully requested tenant token.")
 
@@ -557,15 +1036,18 @@ func (opts *setupOptionsType) getTenantToken(
 }
 
 func (opts *setupOptionsType) tryLoginhostedMender(
-	stdin *stdinReader, validEmailRegex *regexp.Regexp) error {
+	stdin prompter, validEmailRegex *regexp.Regexp) error {
 	// Test Hosted Mender credentials
 	var err error
 	var client *http.Client
 	var authReq *http.Request
 	var response *http.Response
+	ctx, cancel := opts.networkContext()
+	defer cancel()
 	for {
 		client = &http.Client{}
-		authReq, err = http.NewRequest(
+		opts.tuneTransport(client)
+		authReq, err = http.NewRequestWithContext(ctx,
 			"POST",
 			hostedMenderURL+
 				"/api/management/v1/useradm/auth/login",
@@ -575,7 +1057,7 @@ func (opts *setupOptionsType) tryLoginhostedMender(
 				"authorization request.")
 		}
 		authReq.SetBasicAuth(opts.username, opts.password)
-		response, err = client.Do(authReq)
+		response, err = opts.requester(client).Do(authReq)
 
 		if response != nil {
 			defer response.Body.Close()
@@ -586,16 +1068,16 @@ func (opts *setupOptionsType) tryLoginhostedMender(
 			// to catch the error by string matching.
 			if strings.Contains(err.Error(),
 				"Temporary failure in name resolution") {
-				fmt.Println(rspConnectionError)
+				fmt.Fprintln(userOutput, rspConnectionError)
 				if err = opts.askCredentials(stdin,
 					validEmailRegex); err != nil {
 					return err
 				}
 				continue
 			}
-			return err
+			return opts.timeoutError(err, "Hosted Mender login")
 		} else if response.StatusCode == 401 {
-			fmt.Println(rspHMLogin)
+			fmt.Fprintln(userOutput, rspHMLogin)
 			err = opts.askCredentials(stdin, validEmailRegex)
 			if err != nil {
 				return err
@@ -612,15 +1094,30 @@ func (opts *setupOptionsType) tryLoginhostedMender(
 	// Get tenant token
 	userToken, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return errors.Wrap(err,
+		return errors.Wrap(opts.timeoutError(err, "Hosted Mender login"),
 			"Error reading authorization token")
 	}
+	logRedactor.addSecret(string(userToken))
 
 	return opts.getTenantToken(client, userToken)
 }
 
+// ensureCredentials prompts for the Hosted Mender credentials, unless both
+// are given as flags with a valid email address.
+func (opts *setupOptionsType) ensureCredentials(ctx *cli.Context,
+	stdin prompter, validEmailRegex *regexp.Regexp) error {
+	if !(ctx.IsSet("username") && ctx.IsSet("password")) {
+		fmt.Fprintln(userOutput, promptCredentials)
+		return opts.askCredentials(stdin, validEmailRegex)
+	} else if !validEmailRegex.Match([]byte(opts.username)) {
+		fmt.Fprintf(userOutput, rspInvalidEmail, opts.username)
+		return opts.askCredentials(stdin, validEmailRegex)
+	}
+	return nil
+}
+
 func (opts *setupOptionsType) askHostedMenderCredentials(ctx *cli.Context,
-	stdin *stdinReader) (int, error) {
+	stdin prompter) (int, error) {
 	validEmailRegex, err := regexp.Compile(validEmailRegularExpression)
 	if err != nil {
 		return stateInvalid, errors.Wrap(err, "Unable to compile regex")
@@ -629,18 +1126,36 @@ func (opts *setupOptionsType) askHostedMenderCredentials(ctx *cli.Context,
 	if ctx.IsSet("tenant-token") {
 		return statePolling, nil
 	}
-	if !(ctx.IsSet("username") && ctx.IsSet("password")) {
-		fmt.Println(promptCredentials)
-		if err := opts.askCredentials(stdin, validEmailRegex); err != nil {
+	if opts.clientCert != "" &&
+		!(ctx.IsSet("username") || ctx.IsSet("password")) {
+		// The device authenticates with its client certificate.
+		if opts.offline {
+			return statePolling, nil
+		}
+		if err := validateClientCertificate(opts.clientCert,
+			opts.clientKey, opts.sslEngine); err != nil {
 			return stateInvalid, err
 		}
-	} else if !validEmailRegex.Match([]byte(opts.username)) {
-		fmt.Printf(rspInvalidEmail, opts.username)
-		if err := opts.askCredentials(stdin, validEmailRegex); err != nil {
+		return statePolling, nil
+	}
+	if !(ctx.IsSet("username") || ctx.IsSet("password")) {
+		tenantToken, err := readTenantToken(stdin, promptTenantToken)
+		if err != nil {
 			return stateInvalid, err
 		}
+		if tenantToken != "" {
+			opts.tenantToken = tenantToken
+			logRedactor.addSecret(tenantToken)
+			return statePolling, nil
+		}
+	}
+	if err := opts.ensureCredentials(ctx, stdin, validEmailRegex); err != nil {
+		return stateInvalid, err
 	}
 
+	if opts.offline {
+		return stateInvalid, errors.New(errMsgOfflineLogin)
+	}
 	err = opts.tryLoginhostedMender(stdin, validEmailRegex)
 	if err != nil {
 		return stateInvalid, err
@@ -650,9 +1165,9 @@ func (opts *setupOptionsType) askHostedMenderCredentials(ctx *cli.Context,
 }
 
 func (opts *setupOptionsType) askUpdatePoll(ctx *cli.Context,
-	stdin *stdinReader) error {
+	stdin prompter) error {
 	if !ctx.IsSet("update-poll") ||
-		opts.updatePollInterval < minimumPollInterval {
+		opts.updatePollInterval < opts.minPollInterval {
 		rsp, err := stdin.promptUser(
 			promptUpdatePoll, false)
 		if err != nil {
@@ -666,9 +1181,9 @@ func (opts *setupOptionsType) askUpdatePoll(ctx *cli.Context,
 				rsp); err != nil {
 				rsp, err = stdin.promptUser(
 					rspNotSeconds, false)
-			} else if opts.updatePollInterval < minimumPollInterval {
-				rsp, err = stdin.promptUser(
-					rspInvalidInterval, false)
+			} else if opts.updatePollInterval < opts.minPollInterval {
+				rsp, err = stdin.promptUser(fmt.Sprintf(
+					rspInvalidIntervalF, opts.minPollInterval), false)
 			} else {
 				break
 			}
@@ -681,9 +1196,9 @@ func (opts *setupOptionsType) askUpdatePoll(ctx *cli.Context,
 }
 
 func (opts *setupOptionsType) askInventoryPoll(ctx *cli.Context,
-	stdin *stdinReader) error {
+	stdin prompter) error {
 	if !ctx.IsSet("inventory-poll") ||
-		opts.invPollInterval < minimumPollInterval {
+		opts.invPollInterval < opts.minPollInterval {
 		rsp, err := stdin.promptUser(
 			promptInventoryPoll, false)
 		if err != nil {
@@ -697,9 +1212,9 @@ func (opts *setupOptionsType) askInventoryPoll(ctx *cli.Context,
 				rsp); err != nil {
 				rsp, err = stdin.promptUser(
 					rspNotSeconds, false)
-			} else if opts.invPollInterval < minimumPollInterval {
-				rsp, err = stdin.promptUser(
-					rspInvalidInterval, false)
+			} else if opts.invPollInterval < opts.minPollInterval {
+				rsp, err = stdin.promptUser(fmt.Sprintf(
+					rspInvalidIntervalF, opts.minPollInterval), false)
 			} else {
 				break
 			}
@@ -712,9 +1227,9 @@ func (opts *setupOptionsType) askInventoryPoll(ctx *cli.Context,
 }
 
 func (opts *setupOptionsType) askRetryPoll(ctx *cli.Context,
-	stdin *stdinReader) error {
+	stdin prompter) error {
 	if !ctx.IsSet("retry-poll") ||
-		opts.retryPollInterval < minimumPollInterval {
+		opts.retryPollInterval < opts.minPollInterval {
 		rsp, err := stdin.promptUser(
 			promptRetryPoll, false)
 		if err != nil {
@@ -728,9 +1243,9 @@ func (opts *setupOptionsType) askRetryPoll(ctx *cli.Context,
 				rsp); err != nil {
 				rsp, err = stdin.promptUser(
 					rspNotSeconds, false)
-			} else if opts.retryPollInterval < minimumPollInterval {
-				rsp, err = stdin.promptUser(
-					rspInvalidInterval, false)
+			} else if opts.retryPollInterval < opts.minPollInterval {
+				rsp, err = stdin.promptUser(fmt.Sprintf(
+					rspInvalidIntervalF, opts.minPollInterval), false)
 			} else {
 				break
 			}
@@ -742,8 +1257,16 @@ func (opts *setupOptionsType) askRetryPoll(ctx *cli.Context,
 	return nil
 }
 
+func warnShortPollInterval(name string, interval, recommended int) {
+	if interval < recommended {
+		log.Warnf("The %s poll interval of %d seconds is below the "+
+			"recommended minimum of %d seconds, and puts load on "+
+			"the server.", name, interval, recommended)
+	}
+}
+
 func (opts *setupOptionsType) askPollingIntervals(ctx *cli.Context,
-	stdin *stdinReader) (int, error) {
+	stdin prompter) (int, error) {
 	if !ctx.IsSet("demo-polling") {
 		demoIntervals, err := stdin.promptYN(promptDemoIntervals, true)
 		if err != nil {
@@ -766,25 +1289,129 @@ func (opts *setupOptionsType) askPollingIntervals(ctx *cli.Context,
 		if err := opts.askRetryPoll(ctx, stdin); err != nil {
 			return stateInvalid, err
 		}
+		warnShortPollInterval("update", opts.updatePollInterval,
+			recommendedUpdatePoll)
+		warnShortPollInterval("inventory", opts.invPollInterval,
+			recommendedInventoryPoll)
+		warnShortPollInterval("retry", opts.retryPollInterval,
+			recommendedRetryPoll)
 	}
 
-	return stateDone, nil
+	return stateProxy, nil
 }
 
-func doSetup(ctx *cli.Context, config *conf.MenderConfigFromFile,
-	opts *setupOptionsType) error {
+func validateProxyURL(proxyURL string) error {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid proxy URL %q", proxyURL)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return errors.Errorf("Invalid proxy URL %q: unsupported scheme %q",
+			proxyURL, u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.Errorf("Invalid proxy URL %q: missing host", proxyURL)
+	}
+	return nil
+}
+
+// getProxyEnv returns the value of the proxy environment variable, accepting
+// the lower case variant as well.
+func getProxyEnv(name string) string {
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+func askProxyURL(stdin prompter, prompt, defaultURL string) (string, error) {
+	rsp, err := stdin.promptUser(fmt.Sprintf(prompt, defaultURL), false)
+	for {
+		if err != nil {
+			return "", err
+		}
+		if rsp == "" {
+			rsp = defaultURL
+		}
+		if rsp == "" || validateProxyURL(rsp) == nil {
+			return rsp, nil
+		}
+		rsp, err = stdin.promptUser(rspInvalidProxyURL, false)
+	}
+}
+
+func (opts *setupOptionsType) askProxy(ctx *cli.Context,
+	stdin prompter) (int, error) {
 	var err error
-	state := stateDeviceType
-	stdin := &stdinReader{
-		reader: bufio.NewReader(os.Stdin),
+	if ctx.IsSet("http-proxy") || ctx.IsSet("https-proxy") ||
+		ctx.IsSet("no-proxy") {
+		for _, proxyURL := range []string{opts.httpProxy, opts.httpsProxy} {
+			if proxyURL == "" {
+				continue
+			}
+			if err = validateProxyURL(proxyURL); err != nil {
+				return stateInvalid, err
+			}
+		}
+		return stateDone, nil
 	}
 
-	// Prompt 'wizard' message
-	if !ctx.Bool("quiet") {
-		fmt.Println(promptWizard)
+	defaultHTTPProxy := getProxyEnv("HTTP_PROXY")
+	defaultHTTPSProxy := getProxyEnv("HTTPS_PROXY")
+	defaultNoProxy := getProxyEnv("NO_PROXY")
+	defaultYes := defaultHTTPProxy != "" || defaultHTTPSProxy != ""
+	yn := "y/N"
+	if defaultYes {
+		yn = "Y/n"
+	}
+	useProxy, err := stdin.promptYN(fmt.Sprintf(promptProxy, yn), defaultYes)
+	if err != nil || !useProxy {
+		return stateDone, err
 	}
 
-	// Prompt the user for config options if not specified by flags
+	if opts.httpProxy, err = askProxyURL(stdin, promptHTTPProxy,
+		defaultHTTPProxy); err != nil {
+		return stateInvalid, err
+	}
+	if opts.httpsProxy, err = askProxyURL(stdin, promptHTTPSProxy,
+		defaultHTTPSProxy); err != nil {
+		return stateInvalid, err
+	}
+	if opts.noProxy, err = stdin.promptUser(
+		fmt.Sprintf(promptNoProxy, defaultNoProxy), false); err != nil {
+		return stateInvalid, err
+	}
+	if opts.noProxy == "" {
+		opts.noProxy = defaultNoProxy
+	}
+	return stateDone, nil
+}
+
+// checkRequiredFlags returns an error if the options setup would prompt for
+// are not given as flags, and there is no one to prompt.
+func (opts *setupOptionsType) checkRequiredFlags(ctx *cli.Context,
+	stdin prompter) error {
+	if !stdin.nonInteractive() {
+		return nil
+	}
+	missing, err := opts.missingRequiredFlags(ctx)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return errors.Errorf(errMsgNoPromptMissingF,
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// askSetupOptions prompts the user for the setup options not given as flags.
+func (opts *setupOptionsType) askSetupOptions(ctx *cli.Context,
+	stdin prompter) error {
+	var err error
+	state := stateDeviceType
 	for state != stateDone {
 		switch state {
 		case stateDeviceType:
@@ -805,21 +1432,203 @@ func doSetup(ctx *cli.Context, config *conf.MenderConfigFromFile,
 		case stateServerCert:
 			state, err = opts.askServerCert(ctx, stdin)
 
+		case stateClientCert:
+			state, err = opts.askClientCert(ctx, stdin)
+
 		case stateCredentials:
 			state, err = opts.askHostedMenderCredentials(ctx, stdin)
 
 		case statePolling:
 			state, err = opts.askPollingIntervals(ctx, stdin)
+
+		case stateProxy:
+			state, err = opts.askProxy(ctx, stdin)
 		}
 		if err != nil {
 			return err
 		}
 	} // END for {state}
-	return opts.saveConfigOptions(config)
+	return nil
 }
 
-func (opts *setupOptionsType) saveConfigOptions(
-	config *conf.MenderConfigFromFile) error {
+// checkSetupTenantToken warns about problems with the tenant token, and
+// prints the tenant it belongs to.
+func (opts *setupOptionsType) checkSetupTenantToken(ctx *cli.Context) {
+	if opts.tenantToken == "" || opts.offline {
+		return
+	}
+	tenantID, warnings := checkTenantToken(opts.tenantToken, time.Now())
+	for _, warning := range warnings {
+		log.Warn(warning)
+	}
+	if tenantID != "" && !ctx.Bool("quiet") {
+		fmt.Fprintf(userOutput, rspTenantTokenTenant, tenantID)
+	}
+}
+
+func doSetup(ctx *cli.Context, config *conf.MenderConfigFromFile,
+	opts *setupOptionsType) (*setupResult, error) {
+	var err error
+	result := &setupResult{ConfigPath: opts.configPath, DryRun: opts.dryRun}
+	before := *config
+	stdin := opts.stdinPrompter()
+
+	if err = opts.checkRequiredFlags(ctx, stdin); err != nil {
+		return result, result.fail(setupStagePrompt, err)
+	}
+
+	// Prompt 'wizard' message
+	if !ctx.Bool("quiet") {
+		fmt.Fprintln(userOutput, promptWizard)
+	}
+
+	// Prompt the user for config options if not specified by flags
+	if err = opts.askSetupOptions(ctx, stdin); err != nil {
+		return result, result.fail(setupStagePrompt, err)
+	}
+	result.DeviceType = opts.deviceType
+	opts.checkSetupTenantToken(ctx)
+
+	if opts.skipConnectivity {
+		result.Connectivity = connectivitySkipped
+	} else if result.Connectivity, err = opts.checkConnectivity(stdin); err != nil {
+		return result, result.fail(setupStageConnectivity, err)
+	}
+	opts.warnServerPollMinimum()
+	if opts.demo {
+		fmt.Fprint(os.Stderr, rspDemoInsecure)
+	}
+	if opts.offline && !ctx.Bool("quiet") {
+		fmt.Fprint(os.Stderr, rspOfflineUnverified)
+	}
+	opts.applySetupOptions(ctx, config)
+	opts.warnUnsignedArtifacts(&before, config)
+	if err = validateConfig(config); err != nil {
+		return result, result.fail(setupStageValidate, err)
+	}
+	if opts.dryRun {
+		err = opts.printConfigDiff(config)
+	} else {
+		err = opts.saveConfigOptions(&before, config)
+		result.BackupPath = opts.backupPath
+		result.Written = opts.configWritten
+		result.MigratedKeys = opts.migratedKeys
+	}
+	if err != nil {
+		return result, result.fail(setupStageSave, err)
+	}
+	if result.ChangedFields, err = changedConfigFields(&before, config); err != nil {
+		return result, result.fail(setupStageSave, err)
+	}
+	return result, nil
+}
+
+// applyFlagOverrides applies the options given as flags to the configuration,
+// leaving the fields for options which are not given untouched.
+func (opts *setupOptionsType) applyFlagOverrides(ctx *cli.Context,
+	config *conf.MenderConfigFromFile) {
+	if opts.hostedMender {
+		opts.serverURL = hostedMenderURL
+	}
+	if opts.hostedMender || ctx.IsSet("server-url") {
+		config.Servers = opts.menderServers()
+		config.ServerURL = ""
+	}
+
+	if opts.demoServer && !opts.hostedMender {
+		config.ServerCertificate = getMenderDemoCertPath()
+	} else if ctx.IsSet("server-cert") {
+		config.ServerCertificate = opts.serverCert
+	}
+	if ctx.IsSet("tenant-token") {
+		config.TenantToken = opts.tenantToken
+	}
+	if opts.demo {
+		config.SkipVerify = true
+	}
+	if ctx.IsSet("client-cert") {
+		config.HttpsClient.Certificate = opts.clientCert
+	}
+	if ctx.IsSet("client-key") {
+		config.HttpsClient.Key = opts.clientKey
+	}
+	if ctx.IsSet("ssl-engine") {
+		config.HttpsClient.SSLEngine = opts.sslEngine
+	}
+	if ctx.IsSet("disable-keep-alive") {
+		config.Connectivity.DisableKeepAlive = opts.disableKeepAlive
+	}
+	if ctx.IsSet("idle-conn-timeout") {
+		config.Connectivity.IdleConnTimeoutSeconds = opts.idleConnTimeout
+	}
+	opts.applyArtifactVerifyKeys(config)
+	opts.applyDualRootfs(config)
+	opts.applyPollOverrides(ctx, config)
+}
+
+// applyPollOverrides applies the demo intervals, or the poll intervals given
+// as flags.
+func (opts *setupOptionsType) applyPollOverrides(ctx *cli.Context,
+	config *conf.MenderConfigFromFile) {
+	if opts.demoIntervals {
+		config.UpdatePollIntervalSeconds = demoUpdatePoll
+		config.InventoryPollIntervalSeconds = demoInventoryPoll
+		config.RetryPollIntervalSeconds = demoRetryPoll
+		config.UpdateControlMapExpirationTimeSeconds = demoControlMapExpiration
+		config.UpdateControlMapBootExpirationTimeSeconds = demoControlMapBootExpiration
+		return
+	}
+	if ctx.IsSet("update-poll") {
+		config.UpdatePollIntervalSeconds = opts.updatePollInterval
+	}
+	if ctx.IsSet("inventory-poll") {
+		config.InventoryPollIntervalSeconds = opts.invPollInterval
+	}
+	if ctx.IsSet("retry-poll") {
+		config.RetryPollIntervalSeconds = opts.retryPollInterval
+	}
+}
+
+// applyArtifactVerifyKeys replaces the artifact verification keys with the
+// ones given. A single key is written as ArtifactVerifyKey, which older
+// clients understand, and several as ArtifactVerifyKeys.
+func (opts *setupOptionsType) applyArtifactVerifyKeys(
+	config *conf.MenderConfigFromFile) {
+	switch len(opts.artifactVerifyKeys) {
+	case 0:
+		return
+	case 1:
+		config.ArtifactVerifyKey = opts.artifactVerifyKeys[0]
+		config.ArtifactVerifyKeys = nil
+	default:
+		config.ArtifactVerifyKey = ""
+		config.ArtifactVerifyKeys = opts.artifactVerifyKeys
+	}
+}
+
+// hasArtifactVerifyKey returns true if the client verifies the signatures of
+// artifacts with the configuration.
+func hasArtifactVerifyKey(config *conf.MenderConfigFromFile) bool {
+	return config.ArtifactVerifyKey != "" || len(config.ArtifactVerifyKeys) > 0
+}
+
+// warnUnsignedArtifacts warns if the client accepts unsigned artifacts with the
+// configuration, while signed artifacts are required, or were required by the
+// existing configuration.
+func (opts *setupOptionsType) warnUnsignedArtifacts(before,
+	config *conf.MenderConfigFromFile) {
+	if hasArtifactVerifyKey(config) {
+		return
+	}
+	if opts.requireSigned || hasArtifactVerifyKey(before) {
+		log.Warn("No artifact verification key is configured, so the " +
+			"client accepts unsigned artifacts; give --artifact-verify-key")
+	}
+}
+
+// applyConfigOptions applies all the setup options to the configuration.
+func (opts *setupOptionsType) applyConfigOptions(
+	config *conf.MenderConfigFromFile) {
 	if opts.demoIntervals {
 		if opts.updatePollInterval > minimumPollInterval {
 			config.UpdatePollIntervalSeconds = opts.
@@ -854,24 +1663,171 @@ func (opts *setupOptionsType) saveConfigOptions(
 	}
 
 	config.TenantToken = opts.tenantToken
+	if opts.demo {
+		config.SkipVerify = true
+	}
+	if opts.clientCert != "" {
+		config.HttpsClient = client.HttpsClient{
+			Certificate: opts.clientCert,
+			Key:         opts.clientKey,
+			SSLEngine:   opts.sslEngine,
+		}
+	}
+	if opts.disableKeepAlive || opts.idleConnTimeout != 0 {
+		config.Connectivity = client.Connectivity{
+			DisableKeepAlive:       opts.disableKeepAlive,
+			IdleConnTimeoutSeconds: opts.idleConnTimeout,
+		}
+	}
+	opts.applyArtifactVerifyKeys(config)
+	opts.applyDualRootfs(config)
 
 	// Make sure devicetypefile and serverURL is set
+	setDefaultDeviceTypeFile(config)
+	config.Servers = opts.menderServers()
+
+	// Avoid possibility of conflicting ServerURL from an old config
+	config.ServerURL = ""
+}
+
+// setDefaultDeviceTypeFile sets the device type file, if not already set.
+func setDefaultDeviceTypeFile(config *conf.MenderConfigFromFile) {
 	if config.DeviceTypeFile == "" {
 		// Default devicetype file as defined in device.go
 		config.DeviceTypeFile = path.Join(conf.GetStateDirPath(), "device_type")
 	}
-	config.Servers = []client.MenderServer{
-		{
-			ServerURL: opts.serverURL},
+}
+
+// applySetupOptions applies the setup options to the configuration. When
+// merging, only the options given as flags are applied, so that the settings
+// of the existing configuration are not reset to the defaults.
+func (opts *setupOptionsType) applySetupOptions(ctx *cli.Context,
+	config *conf.MenderConfigFromFile) {
+	if !opts.merge {
+		opts.applyConfigOptions(config)
+		return
 	}
+	opts.applyFlagOverrides(ctx, config)
+	setDefaultDeviceTypeFile(config)
+}
 
-	// Avoid possibility of conflicting ServerURL from an old config
-	config.ServerURL = ""
+// printConfigDiff prints the difference between the existing configuration
+// file and the configuration setup would write, without writing anything.
+func (opts *setupOptionsType) printConfigDiff(
+	config *conf.MenderConfigFromFile) error {
+	diff, err := configFileDiff(config, opts.configPath, opts.configFormat)
+	if err != nil {
+		return err
+	}
+	if diff == "" {
+		fmt.Fprintf(userOutput, rspDryRunNoChanges, opts.configPath)
+	} else {
+		fmt.Fprint(userOutput, diff)
+	}
+	fmt.Fprintf(userOutput, rspDryRunDeviceType, opts.deviceType,
+		config.DeviceTypeFile)
+	return nil
+}
 
-	if err := conf.SaveConfigFile(config, opts.configPath); err != nil {
+// marshalConfigFiles returns the contents of the configuration file, and of
+// the secrets file if there is one. before is the configuration as it was
+// loaded, to find what to merge.
+func (opts *setupOptionsType) marshalConfigFiles(
+	before, config *conf.MenderConfigFromFile) ([]byte, []byte, error) {
+	var err error
+	mainConfig := config
+	var secretsData []byte
+	if opts.secretsPath != "" {
+		var secrets *configSecrets
+		mainConfig, secrets = splitConfigSecrets(config)
+		// The client reads the secrets file as its fallback
+		// configuration, which is always JSON.
+		if secretsData, err = marshalConfigValue(secrets,
+			configFormatJSON); err != nil {
+			return nil, nil, err
+		}
+	}
+	var data []byte
+	if opts.merge {
+		var fields []string
+		if fields, err = changedConfigFields(before, mainConfig); err == nil {
+			data, opts.migratedKeys, err = mergeConfigData(mainConfig,
+				fields, opts.configPath, opts.configFormat)
+		}
+		for _, migration := range opts.migratedKeys {
+			log.Warnf("Migrated deprecated configuration key: %s", migration)
+		}
+	} else {
+		data, err = marshalConfig(mainConfig, opts.configFormat)
+	}
+	return data, secretsData, err
+}
+
+// writeConfigFile backs up the configuration file and writes data to it,
+// unless it is unchanged. On error the backup is restored, and the secrets
+// file is rolled back.
+func (opts *setupOptionsType) writeConfigFile(data []byte) error {
+	unchanged, err := configFileUnchanged(opts.configPath, data,
+		opts.configFormat)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(opts.configPath); os.IsNotExist(err) {
+		opts.configCreated = true
+	}
+	if !unchanged && !opts.noBackup {
+		opts.backupPath, err = backupConfigFile(opts.configPath,
+			opts.maxBackups)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.serverCertPEM != nil {
+		if err = writeCertificateFile(opts.serverCert,
+			opts.serverCertPEM); err != nil {
+			return err
+		}
+	}
+	if unchanged {
+		log.Infof("The configuration file %q is up to date", opts.configPath)
+		err = ensureConfigFileMode(opts.configPath, opts.configFileMode)
+	} else {
+		err = writeConfigData(data, opts.configPath, opts.configFileMode)
+	}
+	if err != nil {
+		if opts.backupPath != "" {
+			if rErr := restoreConfigBackup(opts.backupPath,
+				opts.configPath); rErr != nil {
+				log.Errorf("Unable to restore the configuration "+
+					"file: %s", rErr.Error())
+			}
+		}
+		opts.rollBackSecretsFile()
+		return err
+	}
+	opts.configWritten = !unchanged
+	return nil
+}
+
+// saveConfigOptions writes the configuration, and the files that go with it.
+// before is the configuration as it was loaded, to find what to merge.
+func (opts *setupOptionsType) saveConfigOptions(
+	before, config *conf.MenderConfigFromFile) error {
+	data, secretsData, err := opts.marshalConfigFiles(before, config)
+	if err != nil {
+		return err
+	}
+	if secretsData != nil {
+		// Written first, so that the secrets are never missing from
+		// both files.
+		if err = opts.saveSecretsFile(secretsData); err != nil {
+			return err
+		}
+	}
+	if err = opts.writeConfigFile(data); err != nil {
 		return err
 	}
-	err := ioutil.WriteFile(config.DeviceTypeFile,
+	err = ioutil.WriteFile(config.DeviceTypeFile,
 		[]byte("device_type="+opts.deviceType), 0644)
 	if err != nil {
 		return errors.Wrap(err, "Error writing to devicefile.")
@@ -880,6 +1836,10 @@ func (opts *setupOptionsType) saveConfigOptions(
 		opts.maybeAddHostLookup()
 	}
 
+	if err = opts.saveProxyOptions(); err != nil {
+		return err
+	}
+
 	if opts.demoServer && (config.ServerCertificate == getMenderDemoCertPath()) {
 		err = opts.installDemoCertificateLocalTrust()
 		if err != nil {
@@ -890,6 +1850,40 @@ func (opts *setupOptionsType) saveConfigOptions(
 	return nil
 }
 
+// saveProxyOptions writes the proxy settings as environment variables for the
+// client service, which picks them up when connecting to the server. Nothing
+// is written if no proxy is configured.
+func (opts *setupOptionsType) saveProxyOptions() error {
+	var buf bytes.Buffer
+	for _, env := range []struct {
+		name  string
+		value string
+	}{
+		{"HTTP_PROXY", opts.httpProxy},
+		{"HTTPS_PROXY", opts.httpsProxy},
+		{"NO_PROXY", opts.noProxy},
+	} {
+		if env.value != "" {
+			fmt.Fprintf(&buf, "Environment=\"%s=%s\"\n", env.name, env.value)
+		}
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	dir := path.Dir(DefaultProxyConfFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "Cannot create directory %q", dir)
+	}
+	// The proxy URLs may contain credentials.
+	err := ioutil.WriteFile(DefaultProxyConfFile,
+		append([]byte("[Service]\n"), buf.Bytes()...), 0600)
+	if err != nil {
+		return errors.Wrap(err, "Error writing proxy configuration")
+	}
+	return nil
+}
+
 func (opts *setupOptionsType) maybeAddHostLookup() {
 	// Regex: $1: schema, $2: URL, $3: path
 	re, err := regexp.Compile(`(https?://)?(.*)(/.*)?`)
@@ -0,0 +1,196 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/conf"
+)
+
+// loadWrittenConfig writes the configuration of opts the way setup does, and
+// loads it back the way the client does.
+func loadWrittenConfig(t *testing.T, opts *setupOptionsType) *conf.MenderConfig {
+	config := &conf.MenderConfigFromFile{}
+	opts.applyConfigOptions(config)
+	data, err := marshalConfig(config, configFormatJSON)
+	assert.NoError(t, err)
+	configFile := filepath.Join(t.TempDir(), "mender.conf")
+	assert.NoError(t, ioutil.WriteFile(configFile, data, 0600))
+	loaded, err := conf.LoadConfig(configFile, "")
+	assert.NoError(t, err)
+	return loaded
+}
+
+// scriptedPrompter answers the setup prompts in order, recording them.
+type scriptedPrompter struct {
+	answers []string
+	prompts []string
+}
+
+func (p *scriptedPrompter) promptUser(prompt string,
+	disableEcho bool) (string, error) {
+	p.prompts = append(p.prompts, prompt)
+	if len(p.answers) == 0 {
+		return "", errors.Errorf("No answer to the prompt %q", prompt)
+	}
+	answer := p.answers[0]
+	p.answers = p.answers[1:]
+	return answer, nil
+}
+
+func (p *scriptedPrompter) promptYN(prompt string,
+	defaultYes bool) (bool, error) {
+	answer, err := p.promptUser(prompt, false)
+	if answer == "" {
+		return defaultYes, err
+	}
+	return answer == "y", err
+}
+
+func (p *scriptedPrompter) readPastedPEM(firstLine string) ([]byte, error) {
+	return nil, errors.New("No PEM data in the script")
+}
+
+func (p *scriptedPrompter) nonInteractive() bool {
+	return false
+}
+
+// runScriptedSetup runs the setup command with args, answering the prompts
+// with stdin.
+func runScriptedSetup(stdin prompter, args ...string) error {
+	defer func(w io.Writer) { userOutput = w }(userOutput)
+	userOutput = ioutil.Discard
+	runOptions := &runOptionsType{}
+	app := &cli.App{
+		// Return the errors instead of exiting.
+		ExitErrHandler: func(*cli.Context, error) {},
+		Commands: []*cli.Command{{
+			Name: "setup",
+			Action: func(ctx *cli.Context) error {
+				runOptions.setupOptions.prompter = stdin
+				return runOptions.setupCLIHandler(ctx)
+			},
+			Flags: runOptions.setupFlags(),
+		}},
+	}
+	return app.Run(append([]string{"mender-setup", "setup"}, args...))
+}
+
+func TestScriptedSetup(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "mender.conf")
+	stdin := &scriptedPrompter{answers: []string{
+		"raspberrypi4",               // device type
+		"n",                          // hosted Mender
+		"n",                          // demo server
+		"https://mender.example.com", // server URL
+		"",                           // server certificate
+		"",                           // client certificate
+		"n",                          // demo polling intervals
+		"600",                        // update poll interval
+		"",                           // inventory poll interval
+		"120",                        // retry poll interval
+		"n",                          // proxy
+	}}
+	err := runScriptedSetup(stdin, "--config", configFile,
+		"--data", dir, "--skip-connectivity-check", "--quiet")
+	assert.NoError(t, err, "prompts: %q", stdin.prompts)
+	assert.Empty(t, stdin.answers, "prompts: %q", stdin.prompts)
+
+	config, err := conf.LoadConfig(configFile, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "https://mender.example.com",
+		config.Servers[0].ServerURL)
+	assert.Equal(t, 600, config.UpdatePollIntervalSeconds)
+	assert.Equal(t, defaultInventoryPoll, config.InventoryPollIntervalSeconds)
+	assert.Equal(t, 120, config.RetryPollIntervalSeconds)
+	deviceType, err := ioutil.ReadFile(filepath.Join(dir, "device_type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "device_type=raspberrypi4", string(deviceType))
+}
+
+func TestNormalizeAPIPathPrefix(t *testing.T) {
+	for prefix, expected := range map[string]string{
+		"":         "",
+		"/":        "",
+		"mender":   "/mender",
+		"/mender/": "/mender",
+		"//a/b//":  "/a/b",
+	} {
+		normalized, err := normalizeAPIPathPrefix(prefix)
+		assert.NoError(t, err, prefix)
+		assert.Equal(t, expected, normalized, prefix)
+	}
+	for _, prefix := range []string{"a?b", "a#b", "a:b", "a b", "a\tb"} {
+		_, err := normalizeAPIPathPrefix(prefix)
+		assert.Error(t, err, prefix)
+	}
+}
+
+func TestServerURLsPrefix(t *testing.T) {
+	for _, test := range []struct {
+		serverURL string
+		prefix    string
+		expected  []string
+	}{
+		{"https://host", "", []string{"https://host"}},
+		{"https://host", "/mender", []string{"https://host/mender"}},
+		{"https://host/", "/mender", []string{"https://host/mender"}},
+		{"https://a, https://b/", "/a/b",
+			[]string{"https://a/a/b", "https://b/a/b"}},
+		// Already ending with the prefix.
+		{"https://host/mender", "/mender", []string{"https://host/mender"}},
+		{"https://host/mender/", "/mender", []string{"https://host/mender"}},
+		{"https://host/xmender", "/mender",
+			[]string{"https://host/xmender/mender"}},
+	} {
+		opts := setupOptionsType{serverURL: test.serverURL,
+			apiPathPrefix: test.prefix}
+		assert.Equal(t, test.expected, opts.serverURLs(),
+			"%q with the prefix %q", test.serverURL, test.prefix)
+	}
+
+	// The client builds the endpoints on the prefixed URL.
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	defer server.Close()
+	prefix, err := normalizeAPIPathPrefix("mender/")
+	assert.NoError(t, err)
+	opts := setupOptionsType{serverURL: server.URL + "/",
+		apiPathPrefix: prefix}
+	_, err = client.NewUpdate().GetScheduledUpdate(server.Client(),
+		opts.menderServers()[0].ServerURL,
+		&client.CurrentUpdate{Artifact: "release-1", DeviceType: "test"})
+	assert.Equal(t, client.ErrNoDeploymentAvailable, errors.Cause(err))
+	assert.Equal(t, []string{
+		"/mender/api/devices/v2/deployments/device/deployments/next",
+	}, paths)
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender/conf"
+)
+
+const (
+	// Stages of the setup, reported for a failed run
+	setupStagePrompt       = "prompt"
+	setupStageConnectivity = "connectivity"
+	setupStageValidate     = "validate"
+	setupStageSave         = "save"
+	setupStageSystemdUnit  = "systemd-unit"
+	setupStageIdentity     = "identity"
+	setupStageInventory    = "inventory"
+	setupStagePostHook     = "post-hook"
+
+	// Results of the connectivity check
+	connectivityOK      = "ok"
+	connectivityFailed  = "failed"
+	connectivitySkipped = "skipped"
+)
+
+// userOutput is where the messages for the user are printed. With
+// --json-summary it is stderr, so that stdout only holds the summary.
+var userOutput io.Writer = os.Stdout
+
+// setupResult describes what a setup run did, for --json-summary.
+type setupResult struct {
+	ConfigPath    string   `json:"config_path"`
+	BackupPath    string   `json:"backup_path,omitempty"`
+	DryRun        bool     `json:"dry_run"`
+	Written       bool     `json:"written"`
+	ChangedFields []string `json:"changed_fields"`
+	MigratedKeys  []string `json:"migrated_keys,omitempty"`
+	Connectivity  string   `json:"connectivity,omitempty"`
+	Authorization string   `json:"authorization,omitempty"`
+	DeviceType    string   `json:"device_type,omitempty"`
+	HookErrors    []string `json:"hook_errors,omitempty"`
+	FailedStage   string   `json:"failed_stage,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// fail records that the run failed in stage, and returns err.
+func (r *setupResult) fail(stage string, err error) error {
+	r.FailedStage = stage
+	r.Error = err.Error()
+	return err
+}
+
+func marshalSetupResult(result *setupResult) ([]byte, error) {
+	data, err := json.MarshalIndent(result, "", "    ")
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to marshal the setup summary")
+	}
+	return data, nil
+}
+
+func printSetupResult(w io.Writer, result *setupResult) error {
+	data, err := marshalSetupResult(result)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// changedConfigFields returns the sorted names of the top level configuration
+// keys which differ between before and after.
+func changedConfigFields(before, after *conf.MenderConfigFromFile) ([]string, error) {
+	fields := func(config *conf.MenderConfigFromFile) (map[string]json.RawMessage, error) {
+		data, err := json.Marshal(config)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to marshal the configuration")
+		}
+		m := map[string]json.RawMessage{}
+		return m, json.Unmarshal(data, &m)
+	}
+	beforeFields, err := fields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := fields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := []string{}
+	for name, value := range afterFields {
+		if !bytes.Equal(beforeFields[name], value) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range beforeFields {
+		if _, ok := afterFields[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	systemdUnitName     = "mender-client.service"
+	defaultMenderBinary = "/usr/bin/mender"
+
+	systemdUnitTemplate = `[Unit]
+Description=Mender OTA update service
+Wants=network-online.target
+After=systemd-resolved.service network-online.target
+
+[Service]
+Type=idle
+User=root
+Group=root
+ExecStart={{.Binary}} --config {{.ConfigPath}} --data {{.DataStore}} daemon
+Restart=on-abort
+
+[Install]
+WantedBy=multi-user.target
+`
+)
+
+type systemdUnitOptions struct {
+	Binary     string
+	ConfigPath string
+	DataStore  string
+}
+
+// generateSystemdUnit writes the service unit for running the client with the
+// generated configuration to dir, or to stdout if dir is empty.
+func generateSystemdUnit(unitOpts systemdUnitOptions, dir string) error {
+	tmpl, err := template.New(systemdUnitName).Parse(systemdUnitTemplate)
+	if err != nil {
+		return errors.Wrap(err, "Unable to parse systemd unit template")
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, unitOpts); err != nil {
+		return errors.Wrap(err, "Unable to generate systemd unit")
+	}
+
+	if dir == "" {
+		fmt.Fprint(userOutput, buf.String())
+		return nil
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "Cannot create directory %q", dir)
+	}
+	unitPath := path.Join(dir, systemdUnitName)
+	if err = ioutil.WriteFile(unitPath, buf.Bytes(), 0644); err != nil {
+		return errors.Wrapf(err, "Error writing systemd unit %q", unitPath)
+	}
+	log.Infof("Wrote systemd unit %q", unitPath)
+	return nil
+}
@@ -0,0 +1,226 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/mendersoftware/mender/conf"
+)
+
+const printDefaultsDescription = "Prints a configuration file holding every " +
+	"key the client reads, set to the values setup uses by default. Keys " +
+	"set to empty values fall back to the client's own defaults. The YAML " +
+	"output explains every key in a comment; JSON and TOML have no " +
+	"comments, and TOML leaves out the keys without a value."
+
+// configKeyDocs describes the configuration keys, by their path in the
+// configuration. The keys themselves are taken from the configuration
+// structure of the client, so a key missing here is still printed, just
+// without a description.
+var configKeyDocs = map[string]string{
+	"ArtifactVerifyKey": "Path to the public key used to verify signed " +
+		"updates. Only one of ArtifactVerifyKey and ArtifactVerifyKeys " +
+		"can be given.",
+	"ArtifactVerifyKeys": "Paths to public keys used to verify signed " +
+		"updates, tried in order until one succeeds.",
+	"HttpsClient":             "Client certificate for mutual TLS.",
+	"HttpsClient.Certificate": "Path to the client certificate.",
+	"HttpsClient.Key":         "Path to the client certificate key.",
+	"HttpsClient.SSLEngine":   "OpenSSL engine holding the key.",
+	"Security":                "Device key parameters.",
+	"Security.AuthPrivateKey": "Path or PKCS#11 URI of the device key used " +
+		"to authenticate with the server; generated if not given.",
+	"Security.SSLEngine": "OpenSSL engine holding the device key.",
+	"Connectivity":       "Connection handling towards the server.",
+	"Connectivity.DisableKeepAlive": "Open a new connection for every " +
+		"request instead of keeping connections alive.",
+	"Connectivity.IdleConnTimeoutSeconds": "Close connections after being " +
+		"idle for this many seconds; 0 keeps them open.",
+	"RootfsPartA": "Device path of the first root file system partition.",
+	"RootfsPartB": "Device path of the second root file system partition.",
+	"BootUtilitiesSetActivePart": "Command setting the partition to " +
+		"boot next.",
+	"BootUtilitiesGetNextActivePart": "Command getting the partition " +
+		"which will boot next.",
+	"DeviceTypeFile": "Path to the file holding the device type.",
+	"DBus":           "D-Bus API of the client.",
+	"DBus.Enabled":   "Enable the D-Bus API.",
+	"UpdateControlMapExpirationTimeSeconds": "Expiration time of update " +
+		"control maps; 0 means twice UpdatePollIntervalSeconds.",
+	"UpdateControlMapBootExpirationTimeSeconds": "Expiration time of " +
+		"update control maps right after boot.",
+	"UpdatePollIntervalSeconds":    "Seconds between checks for updates.",
+	"InventoryPollIntervalSeconds": "Seconds between inventory updates.",
+	"SkipVerify": "Skip verifying the server certificate. Insecure, " +
+		"only for testing.",
+	"RetryPollIntervalSeconds": "Maximum seconds between retries of " +
+		"failed requests to the server.",
+	"RetryPollCount": "Number of retries of failed requests to the " +
+		"server; 0 derives it from RetryPollIntervalSeconds.",
+	"StateScriptTimeoutSeconds": "Seconds a state script may run " +
+		"before it is killed.",
+	"StateScriptRetryTimeoutSeconds": "Seconds a state script may keep " +
+		"asking to be retried.",
+	"StateScriptRetryIntervalSeconds": "Seconds between retries of a " +
+		"state script.",
+	"ModuleTimeoutSeconds": "Seconds an update module may run before " +
+		"it is killed.",
+	"ServerCertificate": "Path to the certificate of the server, or of " +
+		"the CA which signed it, if it is not trusted by the system.",
+	"ServerURL":     "URL of the Mender Server.",
+	"UpdateLogPath": "Directory holding the deployment logs.",
+	"TenantToken": "Tenant token of the organization in hosted Mender, " +
+		"or in an enterprise server.",
+	"Servers": "List of servers, each with a ServerURL, tried in order. " +
+		"Use instead of ServerURL, e.g. [{ServerURL: https://example.com}].",
+	"DaemonLogLevel": "Log level of the client daemon.",
+}
+
+// defaultTemplateConfig returns the configuration setup writes when no options
+// are given.
+func defaultTemplateConfig() *conf.MenderConfigFromFile {
+	return &conf.MenderConfigFromFile{
+		DeviceTypeFile: path.Join(conf.DefaultDataStore, "device_type"),
+		UpdateControlMapBootExpirationTimeSeconds: conf.
+			DefaultUpdateControlMapBootExpirationTimeSeconds,
+		UpdatePollIntervalSeconds:    defaultUpdatePoll,
+		InventoryPollIntervalSeconds: defaultInventoryPoll,
+		RetryPollIntervalSeconds:     defaultRetryPoll,
+		ServerURL:                    defaultServerURL,
+	}
+}
+
+// configTemplateNode returns the node tree of value, with every field
+// included, also when empty. Keys are commented from configKeyDocs.
+func configTemplateNode(value reflect.Value, keyPath string) (*yaml.Node, error) {
+	switch value.Kind() {
+	case reflect.Struct:
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" || !field.IsExported() {
+				continue
+			} else if name == "" {
+				name = field.Name
+			}
+			fieldPath := name
+			if keyPath != "" {
+				fieldPath = keyPath + "." + name
+			}
+			child, err := configTemplateNode(value.Field(i), fieldPath)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, &yaml.Node{
+				Kind:        yaml.ScalarNode,
+				Tag:         "!!str",
+				Value:       name,
+				HeadComment: configKeyDocs[fieldPath],
+			}, child)
+		}
+		return node, nil
+	case reflect.Slice:
+		if value.Len() == 0 {
+			// Null rather than empty, since the client treats an empty
+			// list of Servers as given.
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null",
+				Value: "null"}, nil
+		}
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for i := 0; i < value.Len(); i++ {
+			child, err := configTemplateNode(value.Index(i), keyPath)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, child)
+		}
+		return node, nil
+	case reflect.String:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str",
+			Value: value.String()}, nil
+	case reflect.Bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool",
+			Value: strconv.FormatBool(value.Bool())}, nil
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int",
+			Value: strconv.FormatInt(value.Int(), 10)}, nil
+	}
+	return nil, errors.Errorf("Unsupported type %s of configuration key %q",
+		value.Type(), keyPath)
+}
+
+// marshalConfigTemplate encodes the template configuration in the given
+// format.
+func marshalConfigTemplate(config *conf.MenderConfigFromFile,
+	format string) ([]byte, error) {
+	node, err := configTemplateNode(reflect.ValueOf(*config), "")
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case configFormatJSON:
+		var buf bytes.Buffer
+		if err = encodeJSONNode(&buf, node); err != nil {
+			return nil, err
+		}
+		var indented bytes.Buffer
+		if err = json.Indent(&indented, buf.Bytes(), "", "    "); err != nil {
+			return nil, errors.Wrap(err, "Error encoding configuration to JSON")
+		}
+		return indented.Bytes(), nil
+	case configFormatYAML:
+		data, err := yaml.Marshal(node)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error encoding configuration to YAML")
+		}
+		return data, nil
+	case configFormatTOML:
+		data, err := marshalConfigTemplate(config, configFormatJSON)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = jsonToTOML(data); err != nil {
+			return nil, errors.Wrap(err, "Error encoding configuration to TOML")
+		}
+		return data, nil
+	}
+	return nil, validateConfigFormat(format)
+}
+
+func printDefaultsCLIHandler(ctx *cli.Context) error {
+	if ctx.Args().Len() > 0 {
+		return errors.Errorf(
+			errMsgAmbiguousArgumentsGivenF,
+			ctx.Args().First())
+	}
+	data, err := marshalConfigTemplate(defaultTemplateConfig(),
+		ctx.String("output-format"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.App.Writer, strings.TrimSuffix(string(data), "\n"))
+	return nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigTemplateFormats(t *testing.T) {
+	for _, format := range []string{
+		configFormatJSON, configFormatYAML, configFormatTOML,
+	} {
+		data, err := marshalConfigTemplate(defaultTemplateConfig(), format)
+		assert.NoError(t, err, format)
+		filename := filepath.Join(t.TempDir(), "mender."+format)
+		assert.NoError(t, ioutil.WriteFile(filename, data, 0600))
+
+		loaded, err := loadConfig(filename, "", format)
+		assert.NoError(t, err, format)
+		assert.Equal(t, *defaultTemplateConfig(),
+			loaded.MenderConfigFromFile, format)
+	}
+}
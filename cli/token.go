@@ -0,0 +1,176 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	tenantTokenIssuer = "Mender"
+
+	rspTenantTokenTenant = "Using tenant token for tenant %q.\n"
+
+	promptTenantTokenMore = "The token seems incomplete, paste the rest " +
+		"or enter an empty line to finish: "
+
+	// --tenant-token-file reads the token from stdin with this argument.
+	tenantTokenStdin = "-"
+)
+
+// tenantTokenClaims holds the claims of a tenant token which setup checks.
+type tenantTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	Tenant    string `json:"mender.tenant"`
+}
+
+// parseTenantToken decodes the claims of a tenant token, which is a JSON Web
+// Token. The signature is not verified, that is up to the server.
+func parseTenantToken(token string) (*tenantTokenClaims, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, errors.New("the token is not a JSON Web Token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(
+		strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decode the token claims")
+	}
+	claims := &tenantTokenClaims{}
+	if err = json.Unmarshal(payload, claims); err != nil {
+		return nil, errors.Wrap(err, "unable to parse the token claims")
+	}
+	return claims, nil
+}
+
+// applyTenantTokenFile sets the tenant-token flag to the token read from the
+// file given by --tenant-token-file, so that setup proceeds as if the token
+// was given as a flag, but without it showing up in the process list.
+func applyTenantTokenFile(ctx *cli.Context) error {
+	tokenFile := ctx.String("tenant-token-file")
+	if tokenFile == "" {
+		return nil
+	}
+	if ctx.IsSet("tenant-token") {
+		return errors.Errorf(errMsgConflictingArgumentsF,
+			"tenant-token", "tenant-token-file")
+	}
+	var token string
+	if tokenFile == tenantTokenStdin {
+		line, err := readLine(os.Stdin)
+		if err != nil {
+			return errors.Wrap(err, "Error reading tenant token from stdin")
+		}
+		token = line
+	} else {
+		info, err := os.Stat(tokenFile)
+		if err != nil {
+			return errors.Wrap(err, "Error reading tenant token file")
+		}
+		if info.Mode().Perm()&0004 != 0 {
+			log.Warnf("The tenant token file %q is readable by all "+
+				"users", tokenFile)
+		}
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return errors.Wrap(err, "Error reading tenant token file")
+		}
+		token = string(data)
+	}
+	if token = strings.TrimSpace(token); token == "" {
+		return errors.Errorf("No tenant token in %q", tokenFile)
+	}
+	logRedactor.addSecret(token)
+	return ctx.Set("tenant-token", token)
+}
+
+// readTenantToken prompts for a tenant token without echoing it. A token pasted
+// across several lines is read until it holds the three parts of a JSON Web
+// Token, or until an empty line is entered.
+func readTenantToken(stdin prompter, prompt string) (string, error) {
+	line, err := stdin.promptUser(prompt, true)
+	fmt.Fprintln(userOutput)
+	token := strings.TrimSpace(line)
+	for err == nil && token != "" && strings.Count(token, ".") < 2 {
+		line, err = stdin.promptUser(promptTenantTokenMore, true)
+		fmt.Fprintln(userOutput)
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		token += line
+	}
+	return token, err
+}
+
+// readLine reads a single line from r, one byte at a time so that nothing
+// after the line is consumed.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF {
+			return string(line), nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+// checkTenantToken issues a warning for tenant tokens which do not look like
+// valid Mender tenant tokens, and returns the tenant ID if found. It never
+// fails, since a token may well be opaque to the client.
+func checkTenantToken(token string, now time.Time) (tenantID string, warnings []string) {
+	claims, err := parseTenantToken(token)
+	if err != nil {
+		return "", []string{"Unable to parse the tenant token: " + err.Error()}
+	}
+	if claims.ExpiresAt != 0 && now.After(time.Unix(claims.ExpiresAt, 0)) {
+		warnings = append(warnings, "The tenant token expired at "+
+			time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	}
+	if claims.Issuer != tenantTokenIssuer {
+		warnings = append(warnings, "The tenant token is not issued by "+
+			"Mender (issuer: \""+claims.Issuer+"\")")
+	}
+	tenantID = claims.Tenant
+	if tenantID == "" {
+		tenantID = claims.Subject
+	}
+	if tenantID == "" {
+		warnings = append(warnings, "The tenant token does not identify a tenant")
+	}
+	return tenantID, warnings
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/conf"
+)
+
+// redactedHeaders are the headers whose values are never logged.
+var redactedHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+	"Set-Cookie":    true,
+}
+
+// tracingRequester logs the connection events and headers of every request
+// made through it, for --trace-http.
+type tracingRequester struct {
+	api client.ApiRequester
+}
+
+// userAgentRequester sets the User-Agent of every request made through it
+// which does not have one, so that the requests of setup can be told apart
+// from the ones of the client in the server logs.
+type userAgentRequester struct {
+	api       client.ApiRequester
+	userAgent string
+}
+
+func (u *userAgentRequester) Do(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", u.userAgent)
+	}
+	return u.api.Do(req)
+}
+
+// defaultUserAgent names the tool and its version.
+func defaultUserAgent() string {
+	return "mender-setup/" + conf.VersionString()
+}
+
+// requester returns api, traced if --trace-http is given, and sending the
+// User-Agent of --user-agent.
+func (opts *setupOptionsType) requester(api client.ApiRequester) client.ApiRequester {
+	if opts.traceHTTP {
+		api = &tracingRequester{api: api}
+	}
+	userAgent := opts.userAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent()
+	}
+	return &userAgentRequester{api: api, userAgent: userAgent}
+}
+
+func (t *tracingRequester) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	since := func() time.Duration {
+		return time.Since(start).Round(time.Millisecond)
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			log.Debugf("HTTP trace: DNS lookup of %s", info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			log.Debugf("HTTP trace: DNS lookup done after %s: %v, error: %v",
+				since(), info.Addrs, info.Err)
+		},
+		ConnectStart: func(network, addr string) {
+			log.Debugf("HTTP trace: connecting to %s (%s)", addr, network)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			log.Debugf("HTTP trace: connected to %s after %s, error: %v",
+				addr, since(), err)
+		},
+		TLSHandshakeStart: func() {
+			log.Debug("HTTP trace: TLS handshake started")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			log.Debugf("HTTP trace: TLS handshake done after %s: "+
+				"version %s, server name %q, error: %v", since(),
+				tls.VersionName(state.Version), state.ServerName, err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			log.Debugf("HTTP trace: got connection to %s, reused: %t, "+
+				"was idle: %t", info.Conn.RemoteAddr(), info.Reused,
+				info.WasIdle)
+		},
+		GotFirstResponseByte: func() {
+			log.Debugf("HTTP trace: first response byte after %s", since())
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	log.Debugf("HTTP trace: %s %s", req.Method, req.URL.Redacted())
+	logTracedHeaders("request", req.Header)
+	rsp, err := t.api.Do(req)
+	if err != nil {
+		log.Debugf("HTTP trace: request failed after %s: %v", since(), err)
+		return rsp, err
+	}
+	log.Debugf("HTTP trace: %s after %s", rsp.Status, since())
+	logTracedHeaders("response", rsp.Header)
+	return rsp, nil
+}
+
+func logTracedHeaders(kind string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if redactedHeaders[http.CanonicalHeaderKey(name)] {
+			value = maskSecret(value)
+		}
+		log.Debugf("HTTP trace: %s header %s: %s", kind, name, value)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserAgent(t *testing.T) {
+	var userAgents []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			userAgents = append(userAgents, r.UserAgent())
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+	defer server.Close()
+
+	for _, userAgent := range []string{"", "fleet-provisioning/1.0"} {
+		userAgents = nil
+		opts := &setupOptionsType{
+			serverURL: server.URL,
+			userAgent: userAgent,
+			timeout:   defaultNetworkTimeout,
+		}
+		result, err := opts.checkConnectivity(&scriptedPrompter{})
+		assert.NoError(t, err)
+		assert.Equal(t, connectivityOK, result)
+		if userAgent == "" {
+			userAgent = defaultUserAgent()
+		}
+		assert.Equal(t, []string{userAgent}, userAgents)
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/mendersoftware/mender/conf"
+)
+
+const (
+	validateDescription = "Checks an existing configuration file with the " +
+		"same validation setup does before writing it, without prompting " +
+		"or writing anything. Prints every problem found, and exits with a " +
+		"non-zero status if there are any. Unknown and deprecated keys are " +
+		"reported as warnings."
+
+	rspValidateProblemF = "ERROR    %s\n"
+	rspValidateWarningF = "WARNING  %s\n"
+	rspValidateOKF      = "The configuration file %q is valid.\n"
+	errMsgValidateF     = "%d problem(s) found in %q"
+)
+
+// validateResult lists what validate found, for --json.
+type validateResult struct {
+	ConfigPath string   `json:"config_path"`
+	Valid      bool     `json:"valid"`
+	Problems   []string `json:"problems"`
+	Warnings   []string `json:"warnings"`
+}
+
+// configErrors holds all the problems found when validating a configuration.
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return "Invalid configuration:\n\t" + strings.Join(e, "\n\t")
+}
+
+func (e *configErrors) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+// checkIntervals checks the poll intervals and the update control map
+// expiration times.
+func (e *configErrors) checkIntervals(config *conf.MenderConfigFromFile) {
+	for _, interval := range []struct {
+		name  string
+		value int
+	}{
+		{"UpdatePollIntervalSeconds", config.UpdatePollIntervalSeconds},
+		{"InventoryPollIntervalSeconds", config.InventoryPollIntervalSeconds},
+		{"RetryPollIntervalSeconds", config.RetryPollIntervalSeconds},
+	} {
+		// Zero means the field is unset, and the client uses its default.
+		if interval.value < 0 ||
+			(interval.value > 0 && interval.value < minimumPollInterval) {
+			e.add("%s: %d is less than the minimum of %d seconds",
+				interval.name, interval.value, minimumPollInterval)
+		}
+	}
+	for _, expiration := range []struct {
+		name  string
+		value int
+	}{
+		{"UpdateControlMapExpirationTimeSeconds",
+			config.UpdateControlMapExpirationTimeSeconds},
+		{"UpdateControlMapBootExpirationTimeSeconds",
+			config.UpdateControlMapBootExpirationTimeSeconds},
+	} {
+		if expiration.value < 0 {
+			e.add("%s: must not be negative", expiration.name)
+		}
+	}
+}
+
+// checkServerURLs checks the server URL, or the URLs of the servers.
+func (e *configErrors) checkServerURLs(config *conf.MenderConfigFromFile) {
+	if config.ServerURL != "" && len(config.Servers) > 0 {
+		e.add("ServerURL: must not be given together with Servers")
+	}
+	serverURLs := []string{config.ServerURL}
+	if len(config.Servers) > 0 {
+		serverURLs = serverURLs[:0]
+		for _, server := range config.Servers {
+			serverURLs = append(serverURLs, server.ServerURL)
+		}
+	}
+	for _, serverURL := range serverURLs {
+		if err := validateServerURL(serverURL); err != nil {
+			e.add("ServerURL: %s", err.Error())
+		}
+	}
+}
+
+// validateConfig checks the configuration against the constraints of the
+// client, and returns a configErrors listing every problem found, or nil if
+// the configuration is valid.
+func validateConfig(config *conf.MenderConfigFromFile) error {
+	var errs configErrors
+
+	errs.checkIntervals(config)
+	errs.checkServerURLs(config)
+
+	if config.ArtifactVerifyKey != "" && len(config.ArtifactVerifyKeys) > 0 {
+		errs.add("ArtifactVerifyKey: must not be given together with " +
+			"ArtifactVerifyKeys")
+	}
+	if (config.RootfsPartA == "") != (config.RootfsPartB == "") {
+		errs.add("RootfsPartA: both RootfsPartA and RootfsPartB must be given")
+	} else if partA := config.RootfsPartA; partA != "" &&
+		rootfsDevicePath(partA) == rootfsDevicePath(config.RootfsPartB) {
+		errs.add("RootfsPartA: must differ from RootfsPartB")
+	}
+	if (config.HttpsClient.Certificate == "") != (config.HttpsClient.Key == "") {
+		errs.add("HttpsClient: both Certificate and Key must be given")
+	}
+	if config.Connectivity.IdleConnTimeoutSeconds < 0 {
+		errs.add("Connectivity: IdleConnTimeoutSeconds must not be negative")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateServerURL(serverURL string) error {
+	if serverURL == "" {
+		return errors.New("no server URL given")
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return errors.Errorf("%q is not a valid URL: %s", serverURL, err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.Errorf("%q must use the http or https scheme", serverURL)
+	}
+	if u.Host == "" {
+		return errors.Errorf("%q has no host", serverURL)
+	}
+	return nil
+}
+
+// unknownConfigKeys returns warnings for the top level keys in the
+// configuration file data which the client does not read. Like the client,
+// keys are matched without regard to case.
+func unknownConfigKeys(data []byte) ([]string, error) {
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	configType := reflect.TypeOf(conf.MenderConfigFromFile{})
+	var warnings []string
+	for key := range values {
+		if _, found := configType.FieldByNameFunc(func(name string) bool {
+			field, _ := configType.FieldByName(name)
+			jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+			if jsonName == "" {
+				jsonName = name
+			}
+			return strings.EqualFold(jsonName, key)
+		}); found {
+			continue
+		}
+		if newKey, deprecated := deprecatedConfigKeys[key]; deprecated {
+			if newKey == "" {
+				warnings = append(warnings, fmt.Sprintf(
+					"%s: deprecated, and ignored by the client", key))
+			} else {
+				warnings = append(warnings, fmt.Sprintf(
+					"%s: deprecated, use %s", key, newKey))
+			}
+		} else {
+			warnings = append(warnings, fmt.Sprintf(
+				"%s: unknown key, ignored by the client", key))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings, nil
+}
+
+// validateConfigFile checks the configuration file the same way setup checks
+// the configuration before writing it.
+func validateConfigFile(filename, format string) (*validateResult, error) {
+	result := &validateResult{
+		ConfigPath: filename,
+		Problems:   []string{},
+		Warnings:   []string{},
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading configuration file")
+	}
+	config := &conf.MenderConfigFromFile{}
+	if err = readConfigFile(config, filename, format); err != nil {
+		result.Problems = append(result.Problems, err.Error())
+		return result, nil
+	}
+	if format == configFormatTOML {
+		if data, err = tomlToJSON(data); err != nil {
+			return nil, errors.Wrapf(err,
+				"Error parsing configuration file %q", filename)
+		}
+	}
+	if result.Warnings, err = unknownConfigKeys(data); err != nil {
+		return nil, errors.Wrapf(err, "Error parsing configuration file %q",
+			filename)
+	}
+	if err = validateConfig(config); err != nil {
+		var errs configErrors
+		if !errors.As(err, &errs) {
+			return nil, err
+		}
+		result.Problems = append(result.Problems, errs...)
+	}
+	result.Valid = len(result.Problems) == 0
+	return result, nil
+}
+
+func (runOptions *runOptionsType) validateCLIHandler(ctx *cli.Context) error {
+	if ctx.Args().Len() > 0 {
+		return errors.Errorf(
+			errMsgAmbiguousArgumentsGivenF,
+			ctx.Args().First())
+	}
+	configFormat := ctx.String("config-format")
+	if err := validateConfigFormat(configFormat); err != nil {
+		return err
+	}
+	if _, err := os.Stat(runOptions.config); err != nil {
+		return errors.Wrap(err, "Error reading configuration file")
+	}
+	result, err := validateConfigFile(runOptions.config, configFormat)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		data, err := json.MarshalIndent(result, "", "    ")
+		if err != nil {
+			return errors.Wrap(err, "Unable to marshal the validation result")
+		}
+		fmt.Fprintln(ctx.App.Writer, string(data))
+	} else {
+		for _, problem := range result.Problems {
+			fmt.Fprintf(ctx.App.Writer, rspValidateProblemF, problem)
+		}
+		for _, warning := range result.Warnings {
+			fmt.Fprintf(ctx.App.Writer, rspValidateWarningF, warning)
+		}
+		if result.Valid {
+			fmt.Fprintf(ctx.App.Writer, rspValidateOKF, runOptions.config)
+		}
+	}
+	if !result.Valid {
+		return exitWithCode(errors.Errorf(errMsgValidateF,
+			len(result.Problems), runOptions.config), exitCodeValidation)
+	}
+	return nil
+}
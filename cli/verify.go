@@ -0,0 +1,369 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/conf"
+	"github.com/mendersoftware/mender/device"
+	"github.com/mendersoftware/mender/store"
+)
+
+const (
+	verifyDescription = "Checks that the existing installation is able to " +
+		"update: the configuration is valid, the device type file is " +
+		"readable, the server is reachable and has accepted the device, " +
+		"and there is enough free space in the data directory. The " +
+		"update partition is not checked: the client writes the new " +
+		"root file system straight to it, so it holds no file system " +
+		"to measure, while update modules unpack their payloads in the " +
+		"data directory. Prints the result of every check, and exits " +
+		"with a non-zero status if any of them fail."
+
+	// Default free space needed in the data directory, in MiB.
+	defaultMinFreeSpace = 100
+
+	rspVerifyPass   = "PASS  %s\n"
+	rspVerifyFail   = "FAIL  %s: %s\n"
+	errMsgVerifyF   = "%d of %d checks failed"
+	errMsgNotAccept = "the device is not accepted by the server; " +
+		"check that it has been authorized in the Mender UI"
+
+	rspAuthAccepted    = "The device is authorized by the server."
+	rspAuthNotAccepted = "The device is not authorized yet: accept it in " +
+		"the Mender UI, unless it has been rejected."
+	rspAuthFailedF = "Unable to check the authorization of the device: %s\n"
+
+	// Results of --verify-auth
+	authorizationAccepted    = "accepted"
+	authorizationNotAccepted = "not_accepted"
+	authorizationFailed      = "failed"
+)
+
+var errNotAccepted = errors.New(errMsgNotAccept)
+
+// verifyCheck is a single check run by the verify command.
+type verifyCheck struct {
+	name  string
+	check func() error
+}
+
+func (runOptions *runOptionsType) verifyCLIHandler(ctx *cli.Context) error {
+	if ctx.Args().Len() > 0 {
+		return errors.Errorf(
+			errMsgAmbiguousArgumentsGivenF,
+			ctx.Args().First())
+	}
+	if !ctx.IsSet("log-level") {
+		log.SetLevel(log.ErrorLevel)
+	}
+	configFormat := ctx.String("config-format")
+	if err := validateConfigFormat(configFormat); err != nil {
+		return err
+	}
+	runOptions.dataStore = ctx.String("data")
+	timeout := ctx.Duration("timeout")
+
+	var config *conf.MenderConfig
+	checks := []verifyCheck{
+		{"Configuration is valid", func() (err error) {
+			config, err = loadConfig(runOptions.config,
+				runOptions.fallbackConfig, configFormat)
+			if err != nil {
+				return err
+			}
+			logRedactor.addSecret(config.TenantToken)
+			return validateConfig(&config.MenderConfigFromFile)
+		}},
+		{"Device type file matches the configuration", func() error {
+			return verifyDeviceType(config, runOptions.dataStore,
+				ctx.String("device-type"))
+		}},
+		{"Server is reachable", func() error {
+			return verifyServers(config, timeout)
+		}},
+		{"Device is authorized", func() error {
+			reqCtx, cancel := timeoutContext(timeout)
+			defer cancel()
+			return timeoutError(verifyAuthorized(reqCtx, config,
+				runOptions.dataStore), "Authorization check", timeout)
+		}},
+		{"Enough free space in the data directory", func() error {
+			return verifyFreeSpace(runOptions.dataStore,
+				ctx.Uint64("min-free-space"))
+		}},
+	}
+
+	failed := 0
+	for i, c := range checks {
+		var err error
+		if i > 0 && config == nil {
+			// All the other checks need the configuration.
+			err = errors.New("the configuration could not be loaded")
+		} else {
+			err = c.check()
+		}
+		if err != nil {
+			fmt.Fprintf(ctx.App.Writer, rspVerifyFail, c.name, err.Error())
+			failed++
+		} else {
+			fmt.Fprintf(ctx.App.Writer, rspVerifyPass, c.name)
+		}
+	}
+	if failed > 0 {
+		return cli.Exit(fmt.Sprintf(errMsgVerifyF, failed, len(checks)), 1)
+	}
+	return nil
+}
+
+// verifyDeviceType checks that the device type file the client reads holds a
+// valid device type, matching deviceType if given.
+func verifyDeviceType(config *conf.MenderConfig, dataStore, deviceType string) error {
+	deviceTypeFile := config.DeviceTypeFile
+	if deviceTypeFile == "" {
+		deviceTypeFile = path.Join(dataStore, "device_type")
+	}
+	devType, err := device.GetDeviceType(deviceTypeFile)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read %q", deviceTypeFile)
+	}
+	validDeviceRegex, err := regexp.Compile(validDeviceRegularExpression)
+	if err != nil {
+		return errors.Wrap(err, "Unable to compile regex")
+	}
+	if !validDeviceRegex.Match([]byte(devType)) {
+		return errors.Errorf("invalid device type %q in %q",
+			devType, deviceTypeFile)
+	}
+	if deviceType != "" && deviceType != devType {
+		return errors.Errorf("%q holds the device type %q, expected %q",
+			deviceTypeFile, devType, deviceType)
+	}
+	return nil
+}
+
+func configServerURLs(config *conf.MenderConfig) []string {
+	if len(config.Servers) == 0 {
+		return []string{config.ServerURL}
+	}
+	serverURLs := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		serverURLs = append(serverURLs, server.ServerURL)
+	}
+	return serverURLs
+}
+
+// verifyServers probes every server of the configuration, waiting at most
+// timeout for each of them.
+func verifyServers(config *conf.MenderConfig, timeout time.Duration) error {
+	api, err := client.NewApiClient(config.GetHttpConfig())
+	if err != nil {
+		return errors.Wrap(err, "unable to create the HTTP client")
+	}
+	var errs []string
+	for _, serverURL := range configServerURLs(config) {
+		reqCtx, cancel := timeoutContext(timeout)
+		err = probeServer(reqCtx, &userAgentRequester{
+			api: api, userAgent: defaultUserAgent()}, serverURL)
+		cancel()
+		if err = timeoutError(err, "Connectivity check", timeout); err != nil {
+			errs = append(errs, serverURL+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// deviceAuthData builds authentication requests the same way the client does,
+// signed with the device key.
+type deviceAuthData struct {
+	keystore    *store.Keystore
+	tenantToken string
+}
+
+func (d *deviceAuthData) MakeAuthRequest() (*client.AuthRequest, error) {
+	idData, err := device.NewIdentityDataGetter().Get()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get the device identity")
+	}
+	pubKey, err := d.keystore.PublicPEM()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get the device public key")
+	}
+	reqData := client.AuthReqData{
+		IdData:      idData,
+		TenantToken: d.tenantToken,
+		Pubkey:      pubKey,
+	}
+	data, err := reqData.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := d.keystore.Sign(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to sign the authentication request")
+	}
+	return &client.AuthRequest{
+		Data:      data,
+		Token:     client.AuthToken(d.tenantToken),
+		Signature: sig,
+	}, nil
+}
+
+// deviceKeystore returns the keystore holding the device key, as configured
+// for the client.
+func deviceKeystore(config *conf.MenderConfig, dataStore string) *store.Keystore {
+	keyFile := config.Security.AuthPrivateKey
+	if keyFile == "" {
+		return store.NewKeystore(store.NewDirStore(dataStore),
+			conf.DefaultKeyFile, config.Security.SSLEngine, false, "")
+	}
+	if strings.HasPrefix(keyFile, "pkcs11:") {
+		return store.NewKeystore(store.NewDirStore(dataStore),
+			keyFile, config.Security.SSLEngine, true, "")
+	}
+	return store.NewKeystore(store.NewDirStore(path.Dir(keyFile)),
+		path.Base(keyFile), config.Security.SSLEngine, true, "")
+}
+
+// contextRequester sends every request with ctx, so that they are all bounded
+// by its deadline.
+type contextRequester struct {
+	api client.ApiRequester
+	ctx context.Context
+}
+
+func (c *contextRequester) Do(req *http.Request) (*http.Response, error) {
+	return c.api.Do(req.WithContext(c.ctx))
+}
+
+// bearerApiRequester adds the device token to every request.
+type bearerApiRequester struct {
+	api   client.ApiRequester
+	token string
+}
+
+func (b *bearerApiRequester) Do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	return b.api.Do(req)
+}
+
+// authorizeDevice authenticates with the device key, the same way the client
+// does, and returns a requester sending the device token along with the URL of
+// the server. All the requests are bounded by ctx.
+func authorizeDevice(ctx context.Context, config *conf.MenderConfig,
+	dataStore string) (client.ApiRequester, string, error) {
+	keystore := deviceKeystore(config, dataStore)
+	if err := keystore.Load(); err != nil {
+		if store.IsNoKeys(err) {
+			return nil, "", errors.New("the device has no key yet; " +
+				"start the client to generate one")
+		}
+		return nil, "", errors.Wrap(err, "unable to load the device key")
+	}
+	apiClient, err := client.NewApiClient(config.GetHttpConfig())
+	if err != nil {
+		return nil, "", errors.Wrap(err, "unable to create the HTTP client")
+	}
+	api := &userAgentRequester{api: &contextRequester{api: apiClient, ctx: ctx},
+		userAgent: defaultUserAgent()}
+
+	serverURL := configServerURLs(config)[0]
+	token, err := client.NewAuth().Request(api, serverURL, &deviceAuthData{
+		keystore:    keystore,
+		tenantToken: config.TenantToken,
+	})
+	if err != nil {
+		if errors.Cause(err) == client.AuthErrorUnauthorized {
+			return nil, "", errNotAccepted
+		}
+		return nil, "", err
+	}
+	logRedactor.addSecret(string(token))
+	return &bearerApiRequester{api: api, token: string(token)}, serverURL, nil
+}
+
+// verifyAuthorized authenticates with the device key, and checks that the
+// device is allowed to ask for updates.
+func verifyAuthorized(ctx context.Context, config *conf.MenderConfig,
+	dataStore string) error {
+	api, serverURL, err := authorizeDevice(ctx, config, dataStore)
+	if err != nil {
+		return err
+	}
+	// Described the same way as by the client, as the server rejects a
+	// request without the artifact name.
+	current, err := currentUpdate(config, dataStore)
+	if err != nil {
+		return err
+	}
+	_, err = client.NewUpdate().GetScheduledUpdate(api, serverURL, current)
+	switch errors.Cause(err) {
+	case nil, client.ErrNoDeploymentAvailable:
+		return nil
+	case client.ErrNotAuthorized:
+		return errNotAccepted
+	}
+	return err
+}
+
+// checkAuthorization authenticates with the configuration setup wrote, for
+// --verify-auth, and prints the outcome to w. The server gives the same
+// response for pending and rejected devices, so these are not told apart.
+func checkAuthorization(ctx context.Context, config *conf.MenderConfig,
+	dataStore string, w io.Writer) string {
+	switch err := verifyAuthorized(ctx, config, dataStore); err {
+	case nil:
+		fmt.Fprintln(w, rspAuthAccepted)
+		return authorizationAccepted
+	case errNotAccepted:
+		fmt.Fprintln(w, rspAuthNotAccepted)
+		return authorizationNotAccepted
+	default:
+		fmt.Fprintf(w, rspAuthFailedF, err.Error())
+		return authorizationFailed
+	}
+}
+
+// verifyFreeSpace checks that the file system holding dir has at least
+// minFreeMiB of space available.
+func verifyFreeSpace(dir string, minFreeMiB uint64) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return errors.Wrapf(err, "unable to get the free space of %q", dir)
+	}
+	freeMiB := stat.Bavail * uint64(stat.Bsize) / (1024 * 1024)
+	if freeMiB < minFreeMiB {
+		return errors.Errorf("%d MiB available in %q, less than %d MiB",
+			freeMiB, dir, minFreeMiB)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender/conf"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/device"
+	"github.com/mendersoftware/mender/store"
+)
+
+// writeTestDevice gives dataStore a device key, an installed artifact and a
+// device type, and points the identity helper at a script, so that the device
+// can authenticate the same way the client does.
+func writeTestDevice(t *testing.T, dataStore string) *conf.MenderConfig {
+	_, keyFile := writeTestKeyPair(t, dataStore, "device")
+	assert.NoError(t, os.Rename(keyFile,
+		filepath.Join(dataStore, conf.DefaultKeyFile)))
+
+	dbStore := store.NewDBStore(dataStore)
+	assert.NotNil(t, dbStore)
+	assert.NoError(t, dbStore.WriteAll(datastore.ArtifactNameKey,
+		[]byte("release-1")))
+	dbStore.Close()
+
+	deviceTypeFile := filepath.Join(dataStore, "device_type")
+	assert.NoError(t, ioutil.WriteFile(deviceTypeFile,
+		[]byte("device_type=test-device"), 0644))
+
+	helper := filepath.Join(dataStore, "mender-device-identity")
+	assert.NoError(t, ioutil.WriteFile(helper,
+		[]byte("#!/bin/sh\necho mac=00:11:22:33:44:55\n"), 0755))
+	identityDataHelper := device.IdentityDataHelper
+	device.IdentityDataHelper = helper
+	t.Cleanup(func() { device.IdentityDataHelper = identityDataHelper })
+
+	return &conf.MenderConfig{MenderConfigFromFile: conf.MenderConfigFromFile{
+		DeviceTypeFile: deviceTypeFile,
+	}}
+}
+
+func TestVerifyAuthorized(t *testing.T) {
+	dataStore := t.TempDir()
+	config := writeTestDevice(t, dataStore)
+
+	var provides map[string]string
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/devices/v1/authentication/auth_requests":
+				w.Write([]byte("device-token"))
+			case "/api/devices/v2/deployments/device/deployments/next":
+				var body struct {
+					DeviceProvides map[string]string `json:"device_provides"`
+				}
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+				provides = body.DeviceProvides
+				w.WriteHeader(status)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	defer server.Close()
+	config.ServerURL = server.URL
+
+	assert.NoError(t, verifyAuthorized(context.Background(), config,
+		dataStore))
+	assert.Equal(t, map[string]string{
+		"artifact_name": "release-1",
+		"device_type":   "test-device",
+	}, provides)
+
+	status = http.StatusUnauthorized
+	assert.Equal(t, errNotAccepted, verifyAuthorized(context.Background(),
+		config, dataStore))
+}
+
+func TestVerifyServersTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Never answer, like a blackholed server.
+			select {
+			case <-r.Context().Done():
+			case <-done:
+			}
+		}))
+	defer server.Close()
+	defer close(done)
+
+	config := &conf.MenderConfig{MenderConfigFromFile: conf.MenderConfigFromFile{
+		ServerURL: server.URL,
+	}}
+	start := time.Now()
+	err := verifyServers(config, 100*time.Millisecond)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out after 100ms")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
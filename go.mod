@@ -3,11 +3,16 @@ module github.com/mendersoftware/mender-setup
 go 1.20
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/mendersoftware/mender v0.0.0-20230505054108-402618bcddcc
 	github.com/pkg/errors v0.9.1
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/sirupsen/logrus v1.9.0
+	github.com/stretchr/testify v1.8.1
 	github.com/urfave/cli/v2 v2.2.0
+	golang.org/x/sys v0.0.0-20220728004956-3c1f35247d10
 	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -23,12 +28,8 @@ require (
 	github.com/mendersoftware/openssl v1.1.1-0.20221101131127-8797d18baf1a // indirect
 	github.com/mendersoftware/progressbar v0.0.3 // indirect
 	github.com/minio/sha256-simd v1.0.0 // indirect
-	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/remyoudompheng/go-liblzma v0.0.0-20190506200333-81bf2d431b96 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/stretchr/objx v0.5.0 // indirect
-	github.com/stretchr/testify v1.8.1 // indirect
 	github.com/ungerik/go-sysfs v0.0.0-20190613143942-7f098ddb67a6 // indirect
-	golang.org/x/sys v0.0.0-20220728004956-3c1f35247d10 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )